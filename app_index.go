@@ -0,0 +1,169 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	appIndexFileName = "applist.json"
+	// the app list is big and changes slowly, so it's only downloaded again once a day
+	appIndexTTL = 24 * time.Hour
+)
+
+// Local copy of the steam app list, used to find apps by name.
+type appIndex struct {
+	FetchedAt time.Time  `json:"fetched_at"`
+	Apps      []SteamApp `json:"apps"`
+}
+
+type appMatch struct {
+	SteamApp
+	score int
+}
+
+// Directory of the files cached between runs, following the XDG base directory on linux.
+func getCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("can't find user cache directory: %w", err)
+	}
+	return filepath.Join(dir, "steam-query"), nil
+}
+
+// Load the cached app index, downloading it again when it's missing, expired or a refresh is asked.
+func loadAppIndex(ctx context.Context, client *SteamClient, refresh bool) (*appIndex, error) {
+	cacheDir, err := getCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	indexPath := filepath.Join(cacheDir, appIndexFileName)
+
+	if !refresh {
+		index, err := readAppIndex(indexPath)
+		if err == nil && time.Since(index.FetchedAt) < appIndexTTL {
+			return index, nil
+		}
+	}
+
+	apps, err := client.AppList(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("download app list: %w", err)
+	}
+
+	index := &appIndex{FetchedAt: time.Now(), Apps: apps}
+	if err := index.save(indexPath); err != nil {
+		return nil, fmt.Errorf("save app index [%s]: %w", indexPath, err)
+	}
+	return index, nil
+}
+
+func readAppIndex(indexPath string) (*appIndex, error) {
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		return nil, err
+	}
+
+	index := &appIndex{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// The index is written to a temporary file first, so a failed write never leaves a broken index.
+func (idx *appIndex) save(indexPath string) error {
+	if err := os.MkdirAll(filepath.Dir(indexPath), 0o755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := indexPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, indexPath)
+}
+
+// Rank the apps matching the query, from the best match to the worst. Names are compared ignoring
+// case and punctuation.
+func (idx *appIndex) Search(query string, limit int) []appMatch {
+	query = normalizeAppName(query)
+	if query == "" {
+		return nil
+	}
+
+	matches := make([]appMatch, 0)
+	for _, app := range idx.Apps {
+		if score := getMatchScore(normalizeAppName(app.Name), query); score > 0 {
+			matches = append(matches, appMatch{SteamApp: app, score: score})
+		}
+	}
+
+	// shorter names are closer to the query when the score is the same
+	slices.SortFunc(matches, func(a, b appMatch) int {
+		return cmp.Or(
+			cmp.Compare(b.score, a.score),
+			cmp.Compare(len(a.Name), len(b.Name)),
+			cmp.Compare(a.ID, b.ID),
+		)
+	})
+
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches
+}
+
+func normalizeAppName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return ' '
+	}, name)
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// Score how well the name matches the query, both already normalized. Zero means no match.
+func getMatchScore(name, query string) int {
+	switch {
+	case name == "":
+		return 0
+	case name == query:
+		return 100
+	case strings.HasPrefix(name, query):
+		return 80
+	case strings.Contains(name, query):
+		return 60
+	}
+
+	words := strings.Fields(query)
+	if !slices.ContainsFunc(words, func(word string) bool { return !strings.Contains(name, word) }) {
+		return 40
+	}
+
+	// every query character shows up on the name in the same order, e.g. "hk" on "hollow knight"
+	remaining := []rune(strings.ReplaceAll(query, " ", ""))
+	for _, r := range name {
+		if len(remaining) > 0 && remaining[0] == r {
+			remaining = remaining[1:]
+		}
+	}
+	if len(remaining) == 0 {
+		return 20
+	}
+	return 0
+}
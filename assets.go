@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+)
+
+type Screenshot struct {
+	ID            int    `json:"id"`
+	PathThumbnail string `json:"path_thumbnail"`
+	PathFull      string `json:"path_full"`
+}
+
+// Store image downloaded along the trailers.
+type appAsset struct {
+	name string
+	url  string
+}
+
+// Assets are named with the same scheme of the trailers: "<app name> - <asset>.<ext>".
+func getAppAssets(steamAppID string, details SteamAppDetails) []appAsset {
+	baseName := getAppBaseName(steamAppID, details)
+
+	assets := make([]appAsset, 0, 3+len(details.Screenshots))
+	for _, image := range []struct{ name, url string }{
+		{"header", details.HeaderImage},
+		{"capsule", details.CapsuleImage},
+		{"background", details.Background},
+	} {
+		if image.url != "" {
+			assets = append(assets, appAsset{
+				name: fmt.Sprintf("%s - %s%s", baseName, image.name, getURLExtension(image.url)),
+				url:  image.url,
+			})
+		}
+	}
+
+	for _, screenshot := range details.Screenshots {
+		if screenshot.PathFull != "" {
+			assets = append(assets, appAsset{
+				name: fmt.Sprintf("%s - screenshot %d%s", baseName, screenshot.ID, getURLExtension(screenshot.PathFull)),
+				url:  screenshot.PathFull,
+			})
+		}
+	}
+	return assets
+}
+
+func getURLExtension(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || path.Ext(u.Path) == "" {
+		return ".jpg"
+	}
+	return path.Ext(u.Path)
+}
+
+func (e *Engine) downloadAssets(ctx context.Context, details SteamAppDetails) error {
+	assets := getAppAssets(e.steamAppId, details)
+	if len(assets) == 0 {
+		return nil
+	}
+
+	w, err := AcquireWindowTable()
+	if err != nil {
+		return fmt.Errorf("setup window table: %w", err)
+	}
+	defer ReleaseWindowTable()
+
+	progress := NewProgressLine()
+	if _, err := w.addLine(progress.Blocks()...); err != nil {
+		return err
+	}
+
+	stepPercentage := int(math.Ceil((1.0 / float64(len(assets))) * 100.0))
+	for _, asset := range assets {
+		progress.UpdateInfo(fmt.Sprintf("Downloading %s", asset.name))
+
+		outputPath, err := validateOutputPath(outputDir, asset.name)
+		if err != nil {
+			return fmt.Errorf("output path validation: %w", err)
+		}
+
+		if err := e.downloadAsset(ctx, asset.url, outputPath); err != nil {
+			return fmt.Errorf("download asset [%s]: %w", asset.name, err)
+		}
+		progress.Progress(stepPercentage)
+	}
+	return nil
+}
+
+// The asset is written to a partial file first, only being renamed to the final name when its size
+// matches the Content-Length of the response.
+func (e *Engine) downloadAsset(ctx context.Context, assetURL, outputPath string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, assetURL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponseStatus(resp); err != nil {
+		return err
+	}
+
+	partialPath := outputPath + ".part"
+	f, err := os.Create(partialPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partialPath)
+
+	written, err := io.Copy(f, resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if resp.ContentLength >= 0 && written != resp.ContentLength {
+		return fmt.Errorf("incomplete download, got %d of %d bytes", written, resp.ContentLength)
+	}
+
+	return os.Rename(partialPath, outputPath)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+func parseAudioLanguages(value string) []string {
+	languages := make([]string, 0)
+	for _, lang := range strings.Split(value, ",") {
+		if lang = strings.TrimSpace(lang); lang != "" {
+			languages = append(languages, lang)
+		}
+	}
+	return languages
+}
+
+// Renditions of the variant's group, in the order of the manifest. Variants without group don't
+// have any rendition, their audio (if any) is muxed on the variant stream.
+func getGroupRenditions(group string, renditions []*rendition) []*rendition {
+	if group == "" {
+		return nil
+	}
+
+	matched := make([]*rendition, 0, len(renditions))
+	for _, r := range renditions {
+		if r.groupID == group {
+			matched = append(matched, r)
+		}
+	}
+	return matched
+}
+
+// Pick the audio tracks downloaded along the variant: every rendition of its group when all is set,
+// otherwise the first one matching the language preference, falling back to the DEFAULT, the
+// AUTOSELECT and then the first rendition of the group. Renditions muxed on the variant stream come
+// along the video, so they're never downloaded and an empty selection keeps the video file alone.
+func selectAudioRenditions(pl *videoPlaylist, renditions []*rendition, languages []string, all bool) ([]*rendition, error) {
+	candidates := getGroupRenditions(pl.variant.Audio, renditions)
+	if len(candidates) == 0 {
+		if pl.variant.Audio != "" {
+			return nil, fmt.Errorf("trailer manifest doesn't have any audio rendition of group [%s]", pl.variant.Audio)
+		}
+		return nil, nil
+	}
+
+	if all {
+		// players pick the first audio track, so the default one leads
+		all := slices.DeleteFunc(slices.Clone(candidates), func(r *rendition) bool {
+			return r.muxed
+		})
+		slices.SortStableFunc(all, func(a, b *rendition) int {
+			return cmp.Compare(getDefaultRank(a), getDefaultRank(b))
+		})
+		return all, nil
+	}
+
+	if selected := pickAudioRendition(candidates, languages); !selected.muxed {
+		return []*rendition{selected}, nil
+	}
+	return nil, nil
+}
+
+func pickAudioRendition(candidates []*rendition, languages []string) *rendition {
+	for _, lang := range languages {
+		for _, r := range candidates {
+			if matchLanguage(r.language, lang) {
+				return r
+			}
+		}
+	}
+
+	for _, r := range candidates {
+		if r.isDefault {
+			return r
+		}
+	}
+	for _, r := range candidates {
+		if r.autoselect {
+			return r
+		}
+	}
+	return candidates[0]
+}
+
+func getDefaultRank(r *rendition) int {
+	if r.isDefault {
+		return 0
+	}
+	return 1
+}
+
+// Renditions are identified by their URI and attributes, like the video variants.
+func getRenditionKey(r *rendition) string {
+	return fmt.Sprintf("%s|%s|%s|%s", r.uri, r.groupID, r.language, r.name)
+}
+
+// Temporary file of the i-th track, the first one keeps the base name.
+func getTrackFileName(base string, i int) string {
+	if i == 0 {
+		return base
+	}
+	ext := filepath.Ext(base)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(base, ext), i, ext)
+}
+
+// Metadata of the rendition stream on the output file.
+func getStreamMetadata(r *rendition) map[string]string {
+	metadata := make(map[string]string)
+	if lang := getISO639Code(r.language); lang != "" {
+		metadata["language"] = lang
+	}
+	if r.name != "" {
+		metadata["title"] = r.name
+	}
+	return metadata
+}
+
+/**
+ * Languages.
+ */
+
+// A preference matches the rendition language when both are the same tag (e.g. "pt-BR") or the
+// preference is only the language of it (e.g. "pt" or "por").
+func matchLanguage(language, preference string) bool {
+	if language == "" {
+		return false
+	}
+	if strings.EqualFold(language, preference) {
+		return true
+	}
+	if strings.Contains(preference, "-") {
+		return false
+	}
+	code := getISO639Code(language)
+	return code != "" && code == getISO639Code(preference)
+}
+
+// ISO 639-2 codes of the ISO 639-1 languages steam publishes trailers in. Containers store the
+// three letters code, while manifests use BCP 47 tags (e.g. "en-US").
+var iso639Codes = map[string]string{
+	"ar": "ara",
+	"bg": "bul",
+	"cs": "cze",
+	"da": "dan",
+	"de": "ger",
+	"el": "gre",
+	"en": "eng",
+	"es": "spa",
+	"fi": "fin",
+	"fr": "fre",
+	"hu": "hun",
+	"id": "ind",
+	"it": "ita",
+	"ja": "jpn",
+	"ko": "kor",
+	"nl": "dut",
+	"no": "nor",
+	"pl": "pol",
+	"pt": "por",
+	"ro": "rum",
+	"ru": "rus",
+	"sv": "swe",
+	"th": "tha",
+	"tr": "tur",
+	"uk": "ukr",
+	"vi": "vie",
+	"zh": "chi",
+}
+
+// ISO 639-2 code of the language tag, empty when it's unknown.
+func getISO639Code(tag string) string {
+	primary, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+	switch len(primary) {
+	case 2:
+		return iso639Codes[primary]
+	case 3:
+		return primary
+	}
+	return ""
+}
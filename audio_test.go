@@ -0,0 +1,90 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/Eyevinn/hls-m3u8/m3u8"
+)
+
+func getRenditionNames(renditions []*rendition) []string {
+	names := make([]string, len(renditions))
+	for i, r := range renditions {
+		names[i] = r.name
+	}
+	return names
+}
+
+func TestSelectAudioRenditions(t *testing.T) {
+	renditions := []*rendition{
+		{groupID: "lo", name: "lo-es", language: "es"},
+		{groupID: "lo", name: "lo-en", language: "en", autoselect: true},
+		{groupID: "hi", name: "hi-es", language: "es"},
+		{groupID: "hi", name: "hi-en", language: "en", isDefault: true},
+		{groupID: "mx", name: "mx-en", language: "en", isDefault: true, muxed: true},
+		{groupID: "mx", name: "mx-pt", language: "pt-BR"},
+	}
+
+	tests := []struct {
+		name      string
+		group     string
+		languages []string
+		all       bool
+		want      []string
+		wantErr   bool
+	}{
+		{name: "default rendition", group: "hi", want: []string{"hi-en"}},
+		{name: "autoselect rendition", group: "lo", want: []string{"lo-en"}},
+		{name: "language over default", group: "hi", languages: []string{"es"}, want: []string{"hi-es"}},
+		{name: "language fallback", group: "hi", languages: []string{"fr", "es"}, want: []string{"hi-es"}},
+		{name: "all with default first", group: "hi", all: true, want: []string{"hi-en", "hi-es"}},
+		{name: "variant without group", want: []string{}},
+		{name: "muxed default", group: "mx", want: []string{}},
+		{name: "language over muxed", group: "mx", languages: []string{"pt"}, want: []string{"mx-pt"}},
+		{name: "all without muxed", group: "mx", all: true, want: []string{"mx-pt"}},
+		{name: "unknown group", group: "xx", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pl := &videoPlaylist{variant: &m3u8.Variant{VariantParams: m3u8.VariantParams{Audio: tt.group}}}
+			got, err := selectAudioRenditions(pl, renditions, tt.languages, tt.all)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", getRenditionNames(got))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if names := getRenditionNames(got); !slices.Equal(names, tt.want) {
+				t.Errorf("selected = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetGroupRenditions(t *testing.T) {
+	renditions := []*rendition{
+		{groupID: "subs", name: "subs-en"},
+		{groupID: "other", name: "other-de"},
+		{groupID: "subs", name: "subs-pt"},
+	}
+
+	tests := []struct {
+		group string
+		want  []string
+	}{
+		{group: "subs", want: []string{"subs-en", "subs-pt"}},
+		{group: "other", want: []string{"other-de"}},
+		{group: "", want: []string{}},
+		{group: "xx", want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.group, func(t *testing.T) {
+			if got := getRenditionNames(getGroupRenditions(tt.group, renditions)); !slices.Equal(got, tt.want) {
+				t.Errorf("getGroupRenditions(%q) = %v, want %v", tt.group, got, tt.want)
+			}
+		})
+	}
+}
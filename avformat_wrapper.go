@@ -8,7 +8,9 @@ export CGO_LDFLAGS=$(pkg-config --libs libavformat libavcodec libavutil)
 */
 
 /*
+   #include <string.h>
    #include <libavformat/avformat.h>
+   #include <libavcodec/avcodec.h>
 */
 import "C"
 import (
@@ -21,33 +23,39 @@ func AVFormatVersion() {
 	fmt.Printf("AV_FORMAT Version: %d\n", C.avformat_version())
 }
 
+// Input file of TransformMedia. The stream metadata (e.g. "language" of an audio track) is set on
+// every stream copied from the file.
+type MediaInput struct {
+	File           string
+	StreamMetadata map[string]string
+}
 
 // Should have the same purpose as these commands:
 //
 // ffmpeg -i video.m4s -i audio.m4s -c copy output.mp4
 //
-// ffmpeg -f mp4 -i video.m4s -c copy output.mp4
-func TransformMedia(videoFile, audioFile, outputFile string) error {
-	var (
-		inVideoCtx *C.AVFormatContext
-		inAudioCtx *C.AVFormatContext
-		outCtx     *C.AVFormatContext
-	)
+// ffmpeg -f mp4 -i video.m4s -c copy -metadata title=<title> output.mp4
+//
+// Every stream of each input is copied, so a single file with both video and audio is remuxed to
+// the container given by the output file extension.
+func TransformMedia(outputFile string, metadata map[string]string, inputs ...MediaInput) error {
+	var outCtx *C.AVFormatContext
+	inCtxs := make([]*C.AVFormatContext, len(inputs))
 
 	outputName := C.CString(outputFile)
 
 	defer func() {
-		C.avformat_close_input(&inVideoCtx)
-		C.avformat_close_input(&inAudioCtx)
+		for i := range inCtxs {
+			C.avformat_close_input(&inCtxs[i])
+		}
 
 		C.free(unsafe.Pointer(outputName))
 	}()
 
-	if err := setupInputFile(videoFile, &inVideoCtx); err != nil {
-		return err
-	}
-	if err := setupInputFile(audioFile, &inAudioCtx); err != nil {
-		return err
+	for i, input := range inputs {
+		if err := setupInputFile(input.File, &inCtxs[i]); err != nil {
+			return err
+		}
 	}
 
 	if ret := C.avformat_alloc_output_context2(&outCtx, nil, nil, outputName); ret < 0 {
@@ -55,8 +63,32 @@ func TransformMedia(videoFile, audioFile, outputFile string) error {
 	}
 	defer C.avformat_free_context(outCtx)
 
-	outVideoStream := createAndSetupStream(inVideoCtx, outCtx)
-	outAudioStream := createAndSetupStream(inAudioCtx, outCtx)
+	// output stream of each input stream, nil for the skipped ones
+	outStreams := make([][]*outputStream, len(inCtxs))
+	defer func() {
+		for _, streams := range outStreams {
+			for _, outStream := range streams {
+				if outStream != nil && outStream.transcoder != nil {
+					outStream.transcoder.free()
+				}
+			}
+		}
+	}()
+
+	for i, inCtx := range inCtxs {
+		for j := 0; j < int(inCtx.nb_streams); j++ {
+			outStream, err := createAndSetupStream(getAVStreamArrayElement(inCtx.streams, j), outCtx)
+			if err != nil {
+				return fmt.Errorf("[%s]: %w", inputs[i].File, err)
+			}
+			if outStream != nil {
+				setMetadata(&outStream.stream.metadata, inputs[i].StreamMetadata)
+			}
+			outStreams[i] = append(outStreams[i], outStream)
+		}
+	}
+
+	setMetadata(&outCtx.metadata, metadata)
 
 	if (outCtx.oformat.flags & C.AVFMT_NOFILE) == 0 {
 		if C.avio_open(&outCtx.pb, outputName, C.AVIO_FLAG_WRITE) < 0 {
@@ -64,12 +96,18 @@ func TransformMedia(videoFile, audioFile, outputFile string) error {
 		}
 	}
 
-	C.avformat_write_header(outCtx, nil)
+	if C.avformat_write_header(outCtx, nil) < 0 {
+		if (outCtx.oformat.flags & C.AVFMT_NOFILE) == 0 {
+			C.avio_closep(&outCtx.pb)
+		}
+		return fmt.Errorf("can't write [%s] header", outputFile)
+	}
 
 	var packet C.AVPacket
 
-	copyStreamPackets(&packet, outVideoStream, inVideoCtx, outCtx)
-	copyStreamPackets(&packet, outAudioStream, inAudioCtx, outCtx)
+	for i, inCtx := range inCtxs {
+		copyStreamPackets(&packet, outStreams[i], inCtx, outCtx)
+	}
 
 	C.av_write_trailer(outCtx)
 
@@ -86,12 +124,78 @@ func getAVStreamArrayElement(arrPtr **C.AVStream, i int) *C.AVStream {
 	return *elemPtr
 }
 
-func createAndSetupStream(streamCtx, outCtx *C.AVFormatContext) *C.AVStream {
+// Output stream of an input stream. Subtitles the container can't store as they are (e.g. WebVTT
+// on mp4) are transcoded to mov_text, like "-c:s mov_text" does on ffmpeg.
+type outputStream struct {
+	stream     *C.AVStream
+	transcoder *subtitleTranscoder
+}
+
+// Copy the input stream to the output, failing when the output container can't store its codec
+// (e.g. h264 on webm). Streams other than video, audio and subtitles are skipped, returning nil.
+func createAndSetupStream(inStream *C.AVStream, outCtx *C.AVFormatContext) (*outputStream, error) {
+	switch inStream.codecpar.codec_type {
+	case C.AVMEDIA_TYPE_VIDEO, C.AVMEDIA_TYPE_AUDIO, C.AVMEDIA_TYPE_SUBTITLE:
+	default:
+		return nil, nil
+	}
+
+	codecID := inStream.codecpar.codec_id
+
+	// negative means the muxer doesn't know, so only a sure "no" is rejected
+	if C.avformat_query_codec(outCtx.oformat, codecID, C.FF_COMPLIANCE_NORMAL) == 0 {
+		if inStream.codecpar.codec_type == C.AVMEDIA_TYPE_SUBTITLE &&
+			C.avformat_query_codec(outCtx.oformat, C.AV_CODEC_ID_MOV_TEXT, C.FF_COMPLIANCE_NORMAL) == 1 {
+			return createTranscodedStream(inStream, outCtx, C.AV_CODEC_ID_MOV_TEXT)
+		}
+		return nil, fmt.Errorf("codec [%s] can't be stored on [%s] container",
+			C.GoString(C.avcodec_get_name(codecID)), C.GoString(outCtx.oformat.name))
+	}
+
+	var outStream *C.AVStream = C.avformat_new_stream(outCtx, nil)
+	C.avcodec_parameters_copy(outStream.codecpar, inStream.codecpar)
+	outStream.codecpar.codec_tag = getOutputCodecTag(outCtx.oformat, inStream.codecpar)
+	outStream.time_base = inStream.time_base
+
+	return &outputStream{stream: outStream}, nil
+}
+
+func createTranscodedStream(inStream *C.AVStream, outCtx *C.AVFormatContext, codecID C.enum_AVCodecID) (*outputStream, error) {
+	transcoder, err := newSubtitleTranscoder(inStream, codecID)
+	if err != nil {
+		return nil, err
+	}
+
 	var outStream *C.AVStream = C.avformat_new_stream(outCtx, nil)
-	C.avcodec_parameters_copy(outStream.codecpar, getAVStreamArrayElement(streamCtx.streams, 0).codecpar)
-	outStream.time_base = getAVStreamArrayElement(streamCtx.streams, 0).time_base
+	if C.avcodec_parameters_from_context(outStream.codecpar, transcoder.enc) < 0 {
+		transcoder.free()
+		return nil, errors.New("can't setup transcoded subtitle stream")
+	}
+	outStream.time_base = transcoder.enc.time_base
 
-	return outStream
+	return &outputStream{stream: outStream, transcoder: transcoder}, nil
+}
+
+// Same rule used by ffmpeg on stream copy: the input tag is kept when the output container knows
+// it (e.g. "hvc1" instead of "hev1" for HEVC on mp4), otherwise the muxer picks the tag itself.
+func getOutputCodecTag(oformat *C.AVOutputFormat, par *C.AVCodecParameters) C.uint32_t {
+	var tag C.uint
+	if oformat.codec_tag == nil ||
+		C.av_codec_get_id(oformat.codec_tag, C.uint(par.codec_tag)) == par.codec_id ||
+		C.av_codec_get_tag2(oformat.codec_tag, par.codec_id, &tag) == 0 {
+		return par.codec_tag
+	}
+	return 0
+}
+
+func setMetadata(dict **C.AVDictionary, metadata map[string]string) {
+	for key, value := range metadata {
+		cKey := C.CString(key)
+		cValue := C.CString(value)
+		C.av_dict_set(dict, cKey, cValue, 0)
+		C.free(unsafe.Pointer(cKey))
+		C.free(unsafe.Pointer(cValue))
+	}
 }
 
 func setupInputFile(fileName string, formatContext **C.AVFormatContext) error {
@@ -105,10 +209,105 @@ func setupInputFile(fileName string, formatContext **C.AVFormatContext) error {
 	return nil
 }
 
-func copyStreamPackets(packet *C.AVPacket, stream *C.AVStream, streamCtx, outCtx *C.AVFormatContext) {
+func copyStreamPackets(packet *C.AVPacket, streams []*outputStream, streamCtx, outCtx *C.AVFormatContext) {
 	for C.av_read_frame(streamCtx, packet) >= 0 {
-		packet.stream_index = stream.index
-		C.av_interleaved_write_frame(outCtx, packet)
+		idx := int(packet.stream_index)
+		if idx < len(streams) && streams[idx] != nil {
+			out := streams[idx]
+			inTimeBase := getAVStreamArrayElement(streamCtx.streams, idx).time_base
+
+			if out.transcoder != nil {
+				out.transcoder.writePacket(packet, inTimeBase, out.stream, outCtx)
+			} else {
+				// the muxer may change the stream time base when writing the header
+				C.av_packet_rescale_ts(packet, inTimeBase, out.stream.time_base)
+				packet.stream_index = out.stream.index
+				C.av_interleaved_write_frame(outCtx, packet)
+			}
+		}
 		C.av_packet_unref(packet)
 	}
 }
+
+/**
+ * Subtitle transcoding.
+ */
+
+// Big enough for the encoded text of any cue, ffmpeg uses the same size.
+const subtitleBufferSize = 1024 * 1024
+
+// Text subtitles are decoded to ASS events and encoded again with the output codec.
+type subtitleTranscoder struct {
+	dec *C.AVCodecContext
+	enc *C.AVCodecContext
+}
+
+func newSubtitleTranscoder(inStream *C.AVStream, codecID C.enum_AVCodecID) (*subtitleTranscoder, error) {
+	decoder := C.avcodec_find_decoder(inStream.codecpar.codec_id)
+	encoder := C.avcodec_find_encoder(codecID)
+	if decoder == nil || encoder == nil {
+		return nil, fmt.Errorf("can't transcode subtitles from [%s] to [%s]",
+			C.GoString(C.avcodec_get_name(inStream.codecpar.codec_id)), C.GoString(C.avcodec_get_name(codecID)))
+	}
+
+	t := &subtitleTranscoder{
+		dec: C.avcodec_alloc_context3(decoder),
+		enc: C.avcodec_alloc_context3(encoder),
+	}
+
+	C.avcodec_parameters_to_context(t.dec, inStream.codecpar)
+	t.dec.pkt_timebase = inStream.time_base
+	if C.avcodec_open2(t.dec, decoder, nil) < 0 {
+		t.free()
+		return nil, errors.New("can't open subtitle decoder")
+	}
+
+	// the encoder styles the text with the ASS header written by the decoder
+	t.enc.time_base = inStream.time_base
+	if t.dec.subtitle_header != nil {
+		t.enc.subtitle_header = (*C.uint8_t)(C.av_mallocz(C.size_t(t.dec.subtitle_header_size) + 1))
+		C.memcpy(unsafe.Pointer(t.enc.subtitle_header), unsafe.Pointer(t.dec.subtitle_header), C.size_t(t.dec.subtitle_header_size))
+		t.enc.subtitle_header_size = t.dec.subtitle_header_size
+	}
+	if C.avcodec_open2(t.enc, encoder, nil) < 0 {
+		t.free()
+		return nil, errors.New("can't open subtitle encoder")
+	}
+	return t, nil
+}
+
+// Packets without any subtitle are skipped.
+func (t *subtitleTranscoder) writePacket(packet *C.AVPacket, inTimeBase C.AVRational, outStream *C.AVStream, outCtx *C.AVFormatContext) {
+	var sub C.AVSubtitle
+	var gotSub C.int
+	if C.avcodec_decode_subtitle2(t.dec, &sub, &gotSub, packet) < 0 || gotSub == 0 {
+		return
+	}
+	defer C.avsubtitle_free(&sub)
+
+	buf := (*C.uint8_t)(C.av_malloc(subtitleBufferSize))
+	defer C.av_free(unsafe.Pointer(buf))
+
+	size := C.avcodec_encode_subtitle(t.enc, buf, subtitleBufferSize, &sub)
+	if size <= 0 {
+		return
+	}
+
+	out := C.av_packet_alloc()
+	defer C.av_packet_free(&out)
+	if C.av_new_packet(out, size) < 0 {
+		return
+	}
+	C.memcpy(unsafe.Pointer(out.data), unsafe.Pointer(buf), C.size_t(size))
+
+	out.pts = C.av_rescale_q(packet.pts, inTimeBase, outStream.time_base)
+	out.dts = out.pts
+	out.duration = C.av_rescale_q(packet.duration, inTimeBase, outStream.time_base)
+	out.stream_index = outStream.index
+	C.av_interleaved_write_frame(outCtx, out)
+}
+
+func (t *subtitleTranscoder) free() {
+	C.avcodec_free_context(&t.dec)
+	C.avcodec_free_context(&t.enc)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+)
+
+var appIDPattern = regexp.MustCompile("^[0-9]+$")
+
+// Flag value which accumulates every occurrence of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+type appResult struct {
+	// input given by the user when it couldn't be resolved into an app
+	appID string
+	// segment requests sent again after failing
+	retries int
+	err     error
+}
+
+// Read steam app IDs or game page URLs, one per line. Blank lines and lines starting with "#" are skipped.
+// The name "-" reads from stdin.
+func readInputFile(name string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	inputs := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		inputs = append(inputs, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading input file [%s]: %w", name, err)
+	}
+	return inputs, nil
+}
+
+// Resolve every input into steam app IDs, dropping duplicates and keeping the given order.
+// Packages and bundles are expanded into the apps they contain. Inputs which can't be resolved
+// don't stop the others, they're returned as failed results.
+func resolveAppIDs(ctx context.Context, client *SteamClient, inputs []string) ([]string, []appResult) {
+	seen := make(map[string]bool)
+	appIDs := make([]string, 0, len(inputs))
+	failed := make([]appResult, 0)
+	for _, input := range inputs {
+		steamInput := SteamInput{Kind: AppInput, ID: input}
+		if !appIDPattern.MatchString(input) {
+			resolved, err := resolveSteamURL(input)
+			if err != nil {
+				failed = append(failed, appResult{appID: input, err: fmt.Errorf("invalid input: %w", err)})
+				continue
+			}
+			steamInput = resolved
+		}
+
+		expanded, err := client.ExpandAppIDs(ctx, steamInput)
+		if err != nil {
+			failed = append(failed, appResult{appID: input, err: fmt.Errorf("expand %s [%s]: %w", steamInput.Kind, steamInput.ID, err)})
+			continue
+		}
+		if steamInput.Kind != AppInput {
+			fmt.Fprintf(os.Stderr, "%s [%s] expanded into %d apps\n", steamInput.Kind, steamInput.ID, len(expanded))
+		}
+
+		for _, appID := range expanded {
+			if !seen[appID] {
+				seen[appID] = true
+				appIDs = append(appIDs, appID)
+			}
+		}
+	}
+	return appIDs, failed
+}
+
+// Run every app with at most `jobs` of them at the same time. A failing app doesn't stop the others.
+func runBatch(ctx context.Context, appIDs []string, jobs int) []appResult {
+	results := make([]appResult, len(appIDs))
+
+	var g errgroup.Group
+	g.SetLimit(max(jobs, 1))
+	for i, appID := range appIDs {
+		g.Go(func() error {
+			results[i] = runApp(ctx, appID)
+			return nil
+		})
+	}
+	g.Wait()
+
+	return results
+}
+
+// Print the result of each app and return how many of them failed.
+func printBatchSummary(results []appResult) int {
+	failed := 0
+	fmt.Println("Summary:")
+	for _, result := range results {
+		retries := ""
+		if result.retries > 0 {
+			retries = fmt.Sprintf(" (%d segment retries)", result.retries)
+		}
+
+		if result.err != nil {
+			failed++
+			fmt.Printf(" [FAILED] %s%s: %v\n", result.appID, retries, result.err)
+			continue
+		}
+		fmt.Printf(" [OK]     %s%s\n", result.appID, retries)
+	}
+	fmt.Printf("%d succeeded, %d failed\n", len(results)-failed, failed)
+	return failed
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// app details carry the manifest URLs, which steam may change, so they're kept only for a while
+	appDetailsCacheTTL = time.Hour
+	// playlists of published trailers don't change
+	playlistCacheTTL = 24 * time.Hour
+)
+
+// Cached response of a URL, with the validators used to revalidate it once expired.
+type cacheEntry struct {
+	Key          string    `json:"key"`
+	URL          string    `json:"url"`
+	FetchedAt    time.Time `json:"fetched_at"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Body         []byte    `json:"body"`
+}
+
+// On-disk cache of HTTP responses keyed by URL. A nil cache fetches every response from the server,
+// so callers don't need to care whether caching is enabled.
+type ResponseCache struct {
+	dir string
+}
+
+func NewResponseCache(dir string) *ResponseCache {
+	return &ResponseCache{dir: dir}
+}
+
+// Cache used by the steam client and the HLS playlists, nil when disabled by -no-cache.
+var responseCache *ResponseCache
+
+func setupResponseCache(disabled bool) {
+	if disabled {
+		return
+	}
+
+	cacheDir, err := getCacheDir()
+	if err != nil {
+		// running without cache is better than not running at all
+		fmt.Fprintf(os.Stderr, "response cache disabled: %v\n", err)
+		return
+	}
+	responseCache = NewResponseCache(filepath.Join(cacheDir, "http"))
+}
+
+// Get the body of the URL. Entries younger than the TTL are answered without any request, older
+// ones are revalidated with ETag/If-Modified-Since. The check runs on every response from the
+// server, so failed responses are never cached.
+func (c *ResponseCache) Get(ctx context.Context, client *http.Client, rawURL string, ttl time.Duration, check func(*http.Response) error) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	key := getCacheKey(client, req)
+	var entry *cacheEntry
+	if c != nil && ttl > 0 {
+		entry = c.read(key)
+		if entry != nil && time.Since(entry.FetchedAt) < ttl {
+			return entry.Body, nil
+		}
+	}
+	if entry != nil {
+		if entry.ETag != "" {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if entry != nil && resp.StatusCode == http.StatusNotModified {
+		entry.FetchedAt = time.Now()
+		c.write(entry)
+		return entry.Body, nil
+	}
+
+	if err := check(resp); err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if c != nil && ttl > 0 {
+		c.write(&cacheEntry{
+			Key:          key,
+			URL:          rawURL,
+			FetchedAt:    time.Now(),
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			Body:         body,
+		})
+	}
+	return body, nil
+}
+
+// Entries are keyed by URL and the cookies sent along it, since the store answers differently
+// when the age check cookies are set.
+func getCacheKey(client *http.Client, req *http.Request) string {
+	key := req.URL.String()
+	if client.Jar != nil {
+		for _, cookie := range client.Jar.Cookies(req.URL) {
+			key += "\n" + cookie.String()
+		}
+	}
+	return key
+}
+
+func (c *ResponseCache) entryPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// Unreadable entries are handled as missing ones.
+func (c *ResponseCache) read(key string) *cacheEntry {
+	data, err := os.ReadFile(c.entryPath(key))
+	if err != nil {
+		return nil
+	}
+
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil || entry.Key != key {
+		return nil
+	}
+	return entry
+}
+
+// Failing to write an entry only costs a request on the next run, so errors are ignored.
+func (c *ResponseCache) write(entry *cacheEntry) {
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	// entries are replaced at once, since apps running at the same time may share them
+	f, err := os.CreateTemp(c.dir, "entry-*.tmp")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		os.Rename(f.Name(), c.entryPath(entry.Key))
+	}
+}
+
+// steam-query cache clear
+func runCacheCommand(ctx context.Context, args []string) error {
+	if len(args) != 1 || args[0] != "clear" {
+		return fmt.Errorf("unknown cache command [%s], expected \"clear\"", strings.Join(args, " "))
+	}
+
+	cacheDir, err := getCacheDir()
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(cacheDir); err != nil {
+		return fmt.Errorf("clear cache [%s]: %w", cacheDir, err)
+	}
+	fmt.Printf("Removed cache directory [%s]\n", cacheDir)
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/Eyevinn/hls-m3u8/m3u8"
+)
+
+type VideoCodec string
+
+const (
+	H264Codec VideoCodec = "h264"
+	HEVCCodec VideoCodec = "hevc"
+	AV1Codec  VideoCodec = "av1"
+)
+
+// Sample entries used by each codec on the CODECS attribute of the manifests (RFC 6381).
+var videoCodecPrefixes = map[VideoCodec][]string{
+	H264Codec: {"avc1", "avc3"},
+	HEVCCodec: {"hvc1", "hev1"},
+	AV1Codec:  {"av01"},
+}
+
+// Video codecs each output container is able to store.
+var containerVideoCodecs = map[string][]VideoCodec{
+	"mp4":  {H264Codec, HEVCCodec, AV1Codec},
+	"mkv":  {H264Codec, HEVCCodec, AV1Codec},
+	"webm": {AV1Codec},
+}
+
+type AudioCodec string
+
+const (
+	AACCodec    AudioCodec = "aac"
+	OpusCodec   AudioCodec = "opus"
+	VorbisCodec AudioCodec = "vorbis"
+	AC3Codec    AudioCodec = "ac3"
+	EAC3Codec   AudioCodec = "eac3"
+	FLACCodec   AudioCodec = "flac"
+)
+
+var audioCodecPrefixes = map[AudioCodec][]string{
+	AACCodec:    {"mp4a"},
+	OpusCodec:   {"opus"},
+	VorbisCodec: {"vorbis"},
+	AC3Codec:    {"ac-3"},
+	EAC3Codec:   {"ec-3"},
+	FLACCodec:   {"flac"},
+}
+
+// Audio codecs each output container is able to store.
+var containerAudioCodecs = map[string][]AudioCodec{
+	"mp4":  {AACCodec, OpusCodec, AC3Codec, EAC3Codec, FLACCodec},
+	"mkv":  {AACCodec, OpusCodec, VorbisCodec, AC3Codec, EAC3Codec, FLACCodec},
+	"webm": {OpusCodec, VorbisCodec},
+}
+
+// Parse a comma separated list of codecs, e.g. "av1,h264", in the order they should be tried.
+func parseCodecPreference(value string) ([]VideoCodec, error) {
+	codecs := make([]VideoCodec, 0)
+	for _, name := range strings.Split(value, ",") {
+		codec := VideoCodec(strings.ToLower(strings.TrimSpace(name)))
+		if codec == "" {
+			continue
+		}
+		if _, ok := videoCodecPrefixes[codec]; !ok {
+			return nil, fmt.Errorf("unknown video codec [%s]", name)
+		}
+		if !slices.Contains(codecs, codec) {
+			codecs = append(codecs, codec)
+		}
+	}
+
+	if len(codecs) == 0 {
+		return nil, fmt.Errorf("invalid codec preference [%s]", value)
+	}
+	return codecs, nil
+}
+
+func parseContainer(value string) (string, error) {
+	container := strings.ToLower(strings.TrimPrefix(value, "."))
+	if _, ok := containerVideoCodecs[container]; !ok {
+		return "", fmt.Errorf("unknown output container [%s]", value)
+	}
+	return container, nil
+}
+
+// Fail before downloading anything when the container can't store the codec.
+func validateContainerCodec(container string, codec VideoCodec) error {
+	if !slices.Contains(containerVideoCodecs[container], codec) {
+		return fmt.Errorf("codec [%s] can't be stored on [%s] container", codec, container)
+	}
+	return nil
+}
+
+// Fail before downloading any segment when the container can't store the codecs of the chosen
+// variant. Its CODECS attribute lists the audio codecs of every rendition it plays, the ones missing
+// from it are only checked by TransformMedia.
+func validateVariantCodecs(container string, variant *m3u8.Variant, manifestCodec VideoCodec) error {
+	videoCodec := getVariantCodec(variant)
+	if videoCodec == "" {
+		videoCodec = manifestCodec
+	}
+	if err := validateContainerCodec(container, videoCodec); err != nil {
+		return err
+	}
+
+	for _, codec := range getVariantAudioCodecs(variant) {
+		if !slices.Contains(containerAudioCodecs[container], codec) {
+			return fmt.Errorf("audio codec [%s] can't be stored on [%s] container", codec, container)
+		}
+	}
+	return nil
+}
+
+// Codec of the variant given by its CODECS attribute. Empty when the attribute is missing or it
+// doesn't have any known video codec.
+func getVariantCodec(variant *m3u8.Variant) VideoCodec {
+	for _, c := range strings.Split(variant.Codecs, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+		for codec, prefixes := range videoCodecPrefixes {
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(c, prefix) {
+					return codec
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// Known audio codecs of the variant given by its CODECS attribute.
+func getVariantAudioCodecs(variant *m3u8.Variant) []AudioCodec {
+	codecs := make([]AudioCodec, 0)
+	for _, c := range strings.Split(variant.Codecs, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+		for codec, prefixes := range audioCodecPrefixes {
+			if slices.ContainsFunc(prefixes, func(prefix string) bool {
+				return strings.HasPrefix(c, prefix)
+			}) && !slices.Contains(codecs, codec) {
+				codecs = append(codecs, codec)
+			}
+		}
+	}
+	return codecs
+}
+
+// Keep the playlists of the given codec. Variants without a known codec are assumed to have the
+// codec the manifest was published for.
+func filterPlaylistsByCodec(playlists []*videoPlaylist, codec, manifestCodec VideoCodec) []*videoPlaylist {
+	filtered := make([]*videoPlaylist, 0, len(playlists))
+	for _, pl := range playlists {
+		variantCodec := getVariantCodec(pl.variant)
+		if variantCodec == "" {
+			variantCodec = manifestCodec
+		}
+		if variantCodec == codec {
+			filtered = append(filtered, pl)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Eyevinn/hls-m3u8/m3u8"
+)
+
+/**
+ * MPD document, only the elements needed to expand the segments of each representation.
+ */
+
+type mpdDocument struct {
+	XMLName                   xml.Name    `xml:"MPD"`
+	Type                      string      `xml:"type,attr"`
+	MediaPresentationDuration string      `xml:"mediaPresentationDuration,attr"`
+	BaseURLs                  []string    `xml:"BaseURL"`
+	Periods                   []mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	ID              string              `xml:"id,attr"`
+	Duration        string              `xml:"duration,attr"`
+	BaseURLs        []string            `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	AdaptationSets  []mpdAdaptationSet  `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	ID              string              `xml:"id,attr"`
+	ContentType     string              `xml:"contentType,attr"`
+	MimeType        string              `xml:"mimeType,attr"`
+	Codecs          string              `xml:"codecs,attr"`
+	Lang            string              `xml:"lang,attr"`
+	Label           string              `xml:"label,attr"`
+	Width           int                 `xml:"width,attr"`
+	Height          int                 `xml:"height,attr"`
+	FrameRate       string              `xml:"frameRate,attr"`
+	BaseURLs        []string            `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentBase     *mpdSegmentBase     `xml:"SegmentBase"`
+	Representations []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	ID              string              `xml:"id,attr"`
+	Bandwidth       uint32              `xml:"bandwidth,attr"`
+	MimeType        string              `xml:"mimeType,attr"`
+	Codecs          string              `xml:"codecs,attr"`
+	Width           int                 `xml:"width,attr"`
+	Height          int                 `xml:"height,attr"`
+	FrameRate       string              `xml:"frameRate,attr"`
+	BaseURLs        []string            `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentBase     *mpdSegmentBase     `xml:"SegmentBase"`
+	SegmentList     *struct{}           `xml:"SegmentList"`
+}
+
+type mpdSegmentTemplate struct {
+	Media                  string              `xml:"media,attr"`
+	Initialization         string              `xml:"initialization,attr"`
+	StartNumber            *uint64             `xml:"startNumber,attr"`
+	Timescale              *uint64             `xml:"timescale,attr"`
+	Duration               *uint64             `xml:"duration,attr"`
+	PresentationTimeOffset *uint64             `xml:"presentationTimeOffset,attr"`
+	SegmentTimeline        *mpdSegmentTimeline `xml:"SegmentTimeline"`
+}
+
+type mpdSegmentTimeline struct {
+	Segments []mpdTimelineSegment `xml:"S"`
+}
+
+type mpdTimelineSegment struct {
+	T *uint64 `xml:"t,attr"`
+	D uint64  `xml:"d,attr"`
+	R int64   `xml:"r,attr"`
+}
+
+type mpdSegmentBase struct {
+	IndexRange     string  `xml:"indexRange,attr"`
+	Initialization *mpdURL `xml:"Initialization"`
+}
+
+type mpdURL struct {
+	SourceURL string `xml:"sourceURL,attr"`
+	Range     string `xml:"range,attr"`
+}
+
+// Lower levels of the MPD override the attributes of the template defined on the upper levels.
+func mergeSegmentTemplates(parent, child *mpdSegmentTemplate) *mpdSegmentTemplate {
+	if parent == nil {
+		return child
+	}
+	if child == nil {
+		return parent
+	}
+
+	merged := *parent
+	if child.Media != "" {
+		merged.Media = child.Media
+	}
+	if child.Initialization != "" {
+		merged.Initialization = child.Initialization
+	}
+	if child.StartNumber != nil {
+		merged.StartNumber = child.StartNumber
+	}
+	if child.Timescale != nil {
+		merged.Timescale = child.Timescale
+	}
+	if child.Duration != nil {
+		merged.Duration = child.Duration
+	}
+	if child.PresentationTimeOffset != nil {
+		merged.PresentationTimeOffset = child.PresentationTimeOffset
+	}
+	if child.SegmentTimeline != nil {
+		merged.SegmentTimeline = child.SegmentTimeline
+	}
+	return &merged
+}
+
+/**
+ * Segment expansion.
+ */
+
+// $RepresentationID$, $Number$, $Time$ and $Bandwidth$ with an optional width format (e.g. $Number%05d$).
+// The escaped dollar sign is written as $$.
+var templateIdentifierPattern = regexp.MustCompile(`\$(RepresentationID|Number|Time|Bandwidth)?(?:%0(\d+)d)?\$`)
+
+func fillSegmentTemplate(template string, rep mpdRepresentation, number, time uint64) string {
+	return templateIdentifierPattern.ReplaceAllStringFunc(template, func(match string) string {
+		parts := templateIdentifierPattern.FindStringSubmatch(match)
+
+		var value uint64
+		switch parts[1] {
+		case "":
+			return "$"
+		case "RepresentationID":
+			return rep.ID
+		case "Number":
+			value = number
+		case "Time":
+			value = time
+		case "Bandwidth":
+			value = uint64(rep.Bandwidth)
+		}
+
+		if parts[2] != "" {
+			width, _ := strconv.Atoi(parts[2])
+			return fmt.Sprintf("%0*d", width, value)
+		}
+		return strconv.FormatUint(value, 10)
+	})
+}
+
+// Expand the segments of a representation, returning them with the total duration in seconds.
+// The initialization section, when present, is the first segment.
+func expandRepresentationSegments(rep mpdRepresentation, tmpl *mpdSegmentTemplate, segmentBase *mpdSegmentBase, baseURL *url.URL, periodDuration float64) ([]mediaSegment, float64, error) {
+	if rep.SegmentList != nil {
+		return nil, 0, fmt.Errorf("representation [%s] uses SegmentList, which isn't supported", rep.ID)
+	}
+
+	if tmpl != nil {
+		return expandSegmentTemplate(rep, tmpl, baseURL, periodDuration)
+	}
+
+	// SegmentBase (or a plain BaseURL) addresses the whole representation as a single file
+	segments := make([]mediaSegment, 0, 2)
+	if segmentBase != nil && segmentBase.Initialization != nil && segmentBase.Initialization.SourceURL != "" {
+		initURL, err := resolveReference(baseURL, segmentBase.Initialization.SourceURL)
+		if err != nil {
+			return nil, 0, err
+		}
+		segments = append(segments, mediaSegment{url: initURL})
+	}
+	segments = append(segments, mediaSegment{url: baseURL.String()})
+	return segments, periodDuration, nil
+}
+
+func expandSegmentTemplate(rep mpdRepresentation, tmpl *mpdSegmentTemplate, baseURL *url.URL, periodDuration float64) ([]mediaSegment, float64, error) {
+	timescale := uint64(1)
+	if tmpl.Timescale != nil && *tmpl.Timescale > 0 {
+		timescale = *tmpl.Timescale
+	}
+	startNumber := uint64(1)
+	if tmpl.StartNumber != nil {
+		startNumber = *tmpl.StartNumber
+	}
+	var presentationTimeOffset uint64
+	if tmpl.PresentationTimeOffset != nil {
+		presentationTimeOffset = *tmpl.PresentationTimeOffset
+	}
+
+	segments := make([]mediaSegment, 0)
+	appendSegment := func(template string, number, time uint64) error {
+		segmentURL, err := resolveReference(baseURL, fillSegmentTemplate(template, rep, number, time))
+		if err != nil {
+			return err
+		}
+		segments = append(segments, mediaSegment{url: segmentURL})
+		return nil
+	}
+
+	if tmpl.Initialization != "" {
+		if err := appendSegment(tmpl.Initialization, 0, 0); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if tmpl.Media == "" {
+		return nil, 0, fmt.Errorf("representation [%s] segment template doesn't have media attribute", rep.ID)
+	}
+
+	switch {
+	case tmpl.SegmentTimeline != nil:
+		var (
+			time     uint64
+			number   = startNumber
+			duration uint64
+		)
+		timeline := tmpl.SegmentTimeline.Segments
+		for i, s := range timeline {
+			if s.D == 0 {
+				return nil, 0, fmt.Errorf("representation [%s] has a timeline segment without duration", rep.ID)
+			}
+			if s.T != nil {
+				time = *s.T
+			}
+
+			repeat := s.R
+			if repeat < 0 {
+				// negative repeat lasts until the next timeline entry or the end of the period
+				end := presentationTimeOffset + uint64(periodDuration*float64(timescale))
+				if i+1 < len(timeline) && timeline[i+1].T != nil {
+					end = *timeline[i+1].T
+				}
+				if end <= time {
+					return nil, 0, fmt.Errorf("representation [%s] has an open timeline without period duration", rep.ID)
+				}
+				repeat = int64(math.Ceil(float64(end-time)/float64(s.D))) - 1
+			}
+
+			for range repeat + 1 {
+				if err := appendSegment(tmpl.Media, number, time); err != nil {
+					return nil, 0, err
+				}
+				time += s.D
+				duration += s.D
+				number++
+			}
+		}
+		return segments, float64(duration) / float64(timescale), nil
+
+	case tmpl.Duration != nil && *tmpl.Duration > 0:
+		if periodDuration <= 0 {
+			return nil, 0, fmt.Errorf("representation [%s] segment count can't be known without period duration", rep.ID)
+		}
+
+		segmentDuration := float64(*tmpl.Duration) / float64(timescale)
+		count := uint64(math.Ceil(periodDuration / segmentDuration))
+		for i := range count {
+			if err := appendSegment(tmpl.Media, startNumber+i, presentationTimeOffset+i*(*tmpl.Duration)); err != nil {
+				return nil, 0, err
+			}
+		}
+		return segments, periodDuration, nil
+	}
+
+	return nil, 0, fmt.Errorf("representation [%s] segment template doesn't have duration or timeline", rep.ID)
+}
+
+/**
+ * DASH backend.
+ */
+
+type dashBackend struct {
+	httpClient *http.Client
+}
+
+func (b *dashBackend) Load(ctx context.Context, manifestURL string) (*trailerManifest, error) {
+	mpdURL, err := url.Parse(manifestURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DASH manifest URL [%s]: %w", manifestURL, err)
+	}
+
+	doc, err := b.downloadMPD(ctx, manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	return decodeDASHManifest(doc, mpdURL)
+}
+
+func (b *dashBackend) downloadMPD(ctx context.Context, manifestURL string) (*mpdDocument, error) {
+	body, err := responseCache.Get(ctx, b.httpClient, manifestURL, playlistCacheTTL, func(resp *http.Response) error {
+		return checkResponse(resp, "DASH manifest")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var doc mpdDocument
+	if err := xml.Unmarshal(body, &doc); err != nil {
+		return nil, &DecodeError{URL: manifestURL, Err: err}
+	}
+	return &doc, nil
+}
+
+// Trailers are single period presentations, so only the first period is used.
+func decodeDASHManifest(doc *mpdDocument, mpdURL *url.URL) (*trailerManifest, error) {
+	if doc.Type == "dynamic" {
+		return nil, errors.New("live DASH manifests aren't supported")
+	}
+	if len(doc.Periods) == 0 {
+		return nil, errors.New("DASH manifest doesn't have any period")
+	}
+	period := doc.Periods[0]
+
+	periodDuration, err := parseISODuration(cmp.Or(period.Duration, doc.MediaPresentationDuration))
+	if err != nil {
+		return nil, err
+	}
+
+	periodURL, err := resolveBaseURL(mpdURL, doc.BaseURLs, period.BaseURLs)
+	if err != nil {
+		return nil, err
+	}
+
+	const audioGroup = "audio"
+	var (
+		manifest       = &trailerManifest{}
+		audioAlts      []*m3u8.Alternative
+		videoPlaylists []*videoPlaylist
+	)
+
+	for _, as := range period.AdaptationSets {
+		asURL, err := resolveBaseURL(periodURL, as.BaseURLs)
+		if err != nil {
+			return nil, err
+		}
+		asTemplate := mergeSegmentTemplates(period.SegmentTemplate, as.SegmentTemplate)
+
+		var (
+			isAudio       bool
+			audioSegments []mediaSegment
+			audioBitrate  uint32
+		)
+		for _, rep := range as.Representations {
+			repURL, err := resolveBaseURL(asURL, rep.BaseURLs)
+			if err != nil {
+				return nil, err
+			}
+
+			segmentBase := as.SegmentBase
+			if rep.SegmentBase != nil {
+				segmentBase = rep.SegmentBase
+			}
+
+			segments, duration, err := expandRepresentationSegments(rep, mergeSegmentTemplates(asTemplate, rep.SegmentTemplate), segmentBase, repURL, periodDuration)
+			if err != nil {
+				return nil, err
+			}
+
+			switch getContentType(as, rep) {
+			case "video":
+				variant := &m3u8.Variant{
+					URI: rep.ID,
+					VariantParams: m3u8.VariantParams{
+						Bandwidth: rep.Bandwidth,
+						Codecs:    cmp.Or(rep.Codecs, as.Codecs),
+						FrameRate: parseFrameRate(cmp.Or(rep.FrameRate, as.FrameRate)),
+						Audio:     audioGroup,
+					},
+				}
+				if width, height := cmp.Or(rep.Width, as.Width), cmp.Or(rep.Height, as.Height); width > 0 && height > 0 {
+					variant.Resolution = fmt.Sprintf("%dx%d", width, height)
+				}
+
+				videoPlaylists = append(videoPlaylists, &videoPlaylist{
+					variant:  variant,
+					segments: segments,
+					duration: duration,
+				})
+			case "audio":
+				// the highest bitrate represents the adaptation set
+				if !isAudio || rep.Bandwidth > audioBitrate {
+					audioSegments = segments
+					audioBitrate = rep.Bandwidth
+				}
+				isAudio = true
+			}
+		}
+
+		if isAudio {
+			audioAlts = append(audioAlts, &m3u8.Alternative{
+				Type:     "AUDIO",
+				GroupId:  audioGroup,
+				Language: as.Lang,
+				Name:     cmp.Or(as.Label, as.ID),
+			})
+
+			// first audio adaptation set is the default one
+			manifest.audioRenditions = append(manifest.audioRenditions, &rendition{
+				uri:       as.ID,
+				groupID:   audioGroup,
+				name:      cmp.Or(as.Label, as.ID),
+				language:  as.Lang,
+				isDefault: len(manifest.audioRenditions) == 0,
+				segments:  audioSegments,
+			})
+		}
+	}
+
+	for _, pl := range videoPlaylists {
+		pl.variant.Alternatives = audioAlts
+	}
+	manifest.videoPlaylists = videoPlaylists
+	return manifest, nil
+}
+
+func getContentType(as mpdAdaptationSet, rep mpdRepresentation) string {
+	if as.ContentType != "" {
+		return as.ContentType
+	}
+	mimeType, _, _ := strings.Cut(cmp.Or(rep.MimeType, as.MimeType), "/")
+	return mimeType
+}
+
+// Each level of BaseURL is resolved against the previous one, starting from the MPD location.
+func resolveBaseURL(base *url.URL, levels ...[]string) (*url.URL, error) {
+	resolved := base
+	for _, baseURLs := range levels {
+		if len(baseURLs) == 0 {
+			continue
+		}
+
+		var err error
+		resolved, err = resolveURL(resolved, baseURLs[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid BaseURL [%s]: %w", baseURLs[0], err)
+		}
+	}
+	return resolved, nil
+}
+
+func resolveReference(base *url.URL, ref string) (string, error) {
+	resolved, err := resolveURL(base, ref)
+	if err != nil {
+		return "", fmt.Errorf("invalid segment URL [%s]: %w", ref, err)
+	}
+	return resolved.String(), nil
+}
+
+var isoDurationPattern = regexp.MustCompile(`^P(?:(\d+(?:\.\d+)?)Y)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)D)?(?:T(?:(\d+(?:\.\d+)?)H)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// Parse ISO 8601 durations used by MPD documents, like PT1M30.5S or PT1.5M. Years and months don't
+// have a fixed length, so they're taken as 365 and 30 days. Empty durations are zero.
+func parseISODuration(duration string) (float64, error) {
+	if duration == "" {
+		return 0, nil
+	}
+
+	// the pattern matches "P" and "PT" alone, which don't have any unit
+	matches := isoDurationPattern.FindStringSubmatch(duration)
+	if matches == nil || duration == "P" || strings.HasSuffix(duration, "T") {
+		return 0, fmt.Errorf("invalid duration [%s]", duration)
+	}
+
+	const day = 24 * 60 * 60
+	var seconds float64
+	for i, unit := range []float64{365 * day, 30 * day, day, 60 * 60, 60, 1} {
+		if matches[i+1] == "" {
+			continue
+		}
+		value, err := strconv.ParseFloat(matches[i+1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration [%s]: %w", duration, err)
+		}
+		seconds += value * unit
+	}
+	return seconds, nil
+}
+
+// Frame rates are either integers or fractions, like 30000/1001.
+func parseFrameRate(frameRate string) float64 {
+	num, den, isFraction := strings.Cut(frameRate, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !isFraction {
+		return n
+	}
+
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
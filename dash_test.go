@@ -0,0 +1,319 @@
+package main
+
+import (
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func getSegmentURLs(segments []mediaSegment) []string {
+	urls := make([]string, len(segments))
+	for i, seg := range segments {
+		urls[i] = seg.url
+	}
+	return urls
+}
+
+func TestFillSegmentTemplate(t *testing.T) {
+	rep := mpdRepresentation{ID: "v1", Bandwidth: 800000}
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"identifiers", "$RepresentationID$/$Bandwidth$/$Number$-$Time$.m4s", "v1/800000/5-1000.m4s"},
+		{"number width", "chunk-$Number%05d$.m4s", "chunk-00005.m4s"},
+		{"time width", "$Time%06d$.m4s", "001000.m4s"},
+		{"width smaller than value", "$Bandwidth%03d$", "800000"},
+		{"escaped dollar", "a$$b-$Number$", "a$b-5"},
+		{"no identifiers", "init.mp4", "init.mp4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fillSegmentTemplate(tt.template, rep, 5, 1000); got != tt.want {
+				t.Errorf("fillSegmentTemplate(%q) = %q, want %q", tt.template, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandSegmentTemplate(t *testing.T) {
+	baseURL, _ := url.Parse("http://cdn.test/dash/")
+	rep := mpdRepresentation{ID: "v1", Bandwidth: 800000}
+
+	tests := []struct {
+		name           string
+		tmpl           mpdSegmentTemplate
+		periodDuration float64
+		want           []string
+		wantDuration   float64
+		wantErr        bool
+	}{
+		{
+			name: "timeline with repeat",
+			tmpl: mpdSegmentTemplate{
+				Media:          "seg-$Time$.m4s",
+				Initialization: "init-$RepresentationID$.mp4",
+				Timescale:      ptr[uint64](1000),
+				SegmentTimeline: &mpdSegmentTimeline{Segments: []mpdTimelineSegment{
+					{T: ptr[uint64](0), D: 2000, R: 2},
+					{D: 1000},
+				}},
+			},
+			want: []string{
+				"http://cdn.test/dash/init-v1.mp4",
+				"http://cdn.test/dash/seg-0.m4s",
+				"http://cdn.test/dash/seg-2000.m4s",
+				"http://cdn.test/dash/seg-4000.m4s",
+				"http://cdn.test/dash/seg-6000.m4s",
+			},
+			wantDuration: 7,
+		},
+		{
+			name: "timeline with start number",
+			tmpl: mpdSegmentTemplate{
+				Media:       "$Number$.m4s",
+				StartNumber: ptr[uint64](3),
+				SegmentTimeline: &mpdSegmentTimeline{Segments: []mpdTimelineSegment{
+					{D: 4, R: 1},
+				}},
+			},
+			want:         []string{"http://cdn.test/dash/3.m4s", "http://cdn.test/dash/4.m4s"},
+			wantDuration: 8,
+		},
+		{
+			name: "negative repeat until the next entry",
+			tmpl: mpdSegmentTemplate{
+				Media:     "seg-$Time$.m4s",
+				Timescale: ptr[uint64](1000),
+				SegmentTimeline: &mpdSegmentTimeline{Segments: []mpdTimelineSegment{
+					{T: ptr[uint64](0), D: 2000, R: -1},
+					{T: ptr[uint64](5000), D: 1000},
+				}},
+			},
+			want: []string{
+				"http://cdn.test/dash/seg-0.m4s",
+				"http://cdn.test/dash/seg-2000.m4s",
+				"http://cdn.test/dash/seg-4000.m4s",
+				"http://cdn.test/dash/seg-5000.m4s",
+			},
+			wantDuration: 7,
+		},
+		{
+			name: "negative repeat until the end of the period",
+			tmpl: mpdSegmentTemplate{
+				Media:     "seg-$Time$.m4s",
+				Timescale: ptr[uint64](1000),
+				SegmentTimeline: &mpdSegmentTimeline{Segments: []mpdTimelineSegment{
+					{T: ptr[uint64](0), D: 2000, R: -1},
+				}},
+			},
+			periodDuration: 5,
+			want: []string{
+				"http://cdn.test/dash/seg-0.m4s",
+				"http://cdn.test/dash/seg-2000.m4s",
+				"http://cdn.test/dash/seg-4000.m4s",
+			},
+			wantDuration: 6,
+		},
+		{
+			name: "negative repeat without period duration",
+			tmpl: mpdSegmentTemplate{
+				Media: "seg-$Time$.m4s",
+				SegmentTimeline: &mpdSegmentTimeline{Segments: []mpdTimelineSegment{
+					{T: ptr[uint64](0), D: 2, R: -1},
+				}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "timeline segment without duration",
+			tmpl: mpdSegmentTemplate{
+				Media:           "seg-$Time$.m4s",
+				SegmentTimeline: &mpdSegmentTimeline{Segments: []mpdTimelineSegment{{T: ptr[uint64](0)}}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "duration with formatted start number",
+			tmpl: mpdSegmentTemplate{
+				Media:       "chunk-$Number%05d$.m4s",
+				StartNumber: ptr[uint64](7),
+				Duration:    ptr[uint64](4),
+			},
+			periodDuration: 10,
+			want: []string{
+				"http://cdn.test/dash/chunk-00007.m4s",
+				"http://cdn.test/dash/chunk-00008.m4s",
+				"http://cdn.test/dash/chunk-00009.m4s",
+			},
+			wantDuration: 10,
+		},
+		{
+			name: "duration with presentation time offset",
+			tmpl: mpdSegmentTemplate{
+				Media:                  "$Number$-$Time$.m4s",
+				Timescale:              ptr[uint64](1000),
+				Duration:               ptr[uint64](2000),
+				PresentationTimeOffset: ptr[uint64](500),
+			},
+			periodDuration: 4,
+			want:           []string{"http://cdn.test/dash/1-500.m4s", "http://cdn.test/dash/2-2500.m4s"},
+			wantDuration:   4,
+		},
+		{
+			name:    "duration without period duration",
+			tmpl:    mpdSegmentTemplate{Media: "$Number$.m4s", Duration: ptr[uint64](4)},
+			wantErr: true,
+		},
+		{
+			name:    "without media",
+			tmpl:    mpdSegmentTemplate{Initialization: "init.mp4", Duration: ptr[uint64](4)},
+			wantErr: true,
+		},
+		{
+			name:           "without duration or timeline",
+			tmpl:           mpdSegmentTemplate{Media: "$Number$.m4s"},
+			periodDuration: 10,
+			wantErr:        true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segments, duration, err := expandSegmentTemplate(rep, &tt.tmpl, baseURL, tt.periodDuration)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got segments %v", getSegmentURLs(segments))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := getSegmentURLs(segments); !slices.Equal(got, tt.want) {
+				t.Errorf("segments = %v, want %v", got, tt.want)
+			}
+			if duration != tt.wantDuration {
+				t.Errorf("duration = %v, want %v", duration, tt.wantDuration)
+			}
+		})
+	}
+}
+
+func TestExpandRepresentationSegments(t *testing.T) {
+	baseURL, _ := url.Parse("http://cdn.test/video/720.mp4")
+
+	tests := []struct {
+		name        string
+		rep         mpdRepresentation
+		tmpl        *mpdSegmentTemplate
+		segmentBase *mpdSegmentBase
+		want        []string
+		wantErr     bool
+	}{
+		{
+			name: "segment base with initialization",
+			rep:  mpdRepresentation{ID: "720"},
+			segmentBase: &mpdSegmentBase{
+				IndexRange:     "800-1200",
+				Initialization: &mpdURL{SourceURL: "init.mp4"},
+			},
+			want: []string{"http://cdn.test/video/init.mp4", "http://cdn.test/video/720.mp4"},
+		},
+		{
+			name:        "segment base with initialization range",
+			rep:         mpdRepresentation{ID: "720"},
+			segmentBase: &mpdSegmentBase{Initialization: &mpdURL{Range: "0-799"}},
+			want:        []string{"http://cdn.test/video/720.mp4"},
+		},
+		{
+			name: "plain base URL",
+			rep:  mpdRepresentation{ID: "720"},
+			want: []string{"http://cdn.test/video/720.mp4"},
+		},
+		{
+			name: "template over segment base",
+			rep:  mpdRepresentation{ID: "720"},
+			tmpl: &mpdSegmentTemplate{
+				Media:           "$Number$.m4s",
+				SegmentTimeline: &mpdSegmentTimeline{Segments: []mpdTimelineSegment{{D: 6}}},
+			},
+			segmentBase: &mpdSegmentBase{Initialization: &mpdURL{SourceURL: "init.mp4"}},
+			want:        []string{"http://cdn.test/video/1.m4s"},
+		},
+		{
+			name:    "segment list",
+			rep:     mpdRepresentation{ID: "720", SegmentList: &struct{}{}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segments, duration, err := expandRepresentationSegments(tt.rep, tt.tmpl, tt.segmentBase, baseURL, 6)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got segments %v", getSegmentURLs(segments))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := getSegmentURLs(segments); !slices.Equal(got, tt.want) {
+				t.Errorf("segments = %v, want %v", got, tt.want)
+			}
+			if duration != 6 {
+				t.Errorf("duration = %v, want 6", duration)
+			}
+		})
+	}
+}
+
+func TestParseISODuration(t *testing.T) {
+	tests := []struct {
+		duration string
+		want     float64
+		wantErr  bool
+	}{
+		{duration: "", want: 0},
+		{duration: "PT10S", want: 10},
+		{duration: "PT1M30.5S", want: 90.5},
+		{duration: "PT1.5M", want: 90},
+		{duration: "PT0.5H", want: 1800},
+		{duration: "PT1H2M3S", want: 3723},
+		{duration: "P1DT2H", want: 93600},
+		{duration: "P0.5D", want: 43200},
+		{duration: "P1Y", want: 365 * 86400},
+		{duration: "P1M", want: 30 * 86400},
+		{duration: "P1Y2M3DT4H5M6S", want: 365*86400 + 2*30*86400 + 3*86400 + 4*3600 + 5*60 + 6},
+		{duration: "P", wantErr: true},
+		{duration: "PT", wantErr: true},
+		{duration: "P1DT", wantErr: true},
+		{duration: "P1M1Y", wantErr: true},
+		{duration: "1M", wantErr: true},
+		{duration: "PT1,5M", wantErr: true},
+		{duration: "PT5", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.duration, func(t *testing.T) {
+			got, err := parseISODuration(tt.duration)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("parseISODuration(%q) = %v, want %v", tt.duration, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/Eyevinn/hls-m3u8/m3u8"
+)
+
+const (
+	aes128Method = "AES-128"
+	noneMethod   = "NONE"
+	// key format of plain AES keys, served as the 16 bytes of the key
+	identityKeyFormat = "identity"
+)
+
+// Key a segment is encrypted with, using AES-128-CBC with PKCS7 padding.
+type segmentKey struct {
+	url string
+	iv  []byte
+}
+
+// Get the key of the segment from the last EXT-X-KEY tag before it. Segments without an explicit IV
+// use their media sequence number as IV. SAMPLE-AES encrypts the samples inside the container
+// instead of the whole segment, so it can't be decrypted here.
+func getSegmentKey(playlistURL *url.URL, key *m3u8.Key, seqID uint64) (*segmentKey, error) {
+	if key == nil || key.Method == "" || key.Method == noneMethod {
+		return nil, nil
+	}
+
+	if key.Method != aes128Method {
+		return nil, fmt.Errorf("segments encrypted with [%s] aren't supported, only %s can be decrypted", key.Method, aes128Method)
+	}
+	if key.Keyformat != "" && key.Keyformat != identityKeyFormat {
+		return nil, fmt.Errorf("key format [%s] isn't supported, only %q keys can be fetched", key.Keyformat, identityKeyFormat)
+	}
+	if key.URI == "" {
+		return nil, fmt.Errorf("%s key without URI", aes128Method)
+	}
+
+	keyURL, err := resolveURL(playlistURL, key.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if key.IV != "" {
+		iv, err = parseKeyIV(key.IV)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		binary.BigEndian.PutUint64(iv[8:], seqID)
+	}
+	return &segmentKey{url: keyURL.String(), iv: iv}, nil
+}
+
+// IV attribute is an hexadecimal number of 128 bits, e.g. 0x0000000000000000000000000000002A.
+func parseKeyIV(value string) ([]byte, error) {
+	digits := strings.TrimPrefix(strings.TrimPrefix(value, "0x"), "0X")
+	iv, err := hex.DecodeString(digits)
+	if err != nil || len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid key IV [%s]", value)
+	}
+	return iv, nil
+}
+
+// Keys downloaded by the engine, by URL. Every segment of a playlist usually shares the same key,
+// so it's only requested once.
+type keyCache struct {
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+// Keys aren't written to the response cache, so they never end up on disk.
+func (e *Engine) getKey(ctx context.Context, keyURL string) ([]byte, error) {
+	e.keys.mu.Lock()
+	defer e.keys.mu.Unlock()
+
+	if key, ok := e.keys.keys[keyURL]; ok {
+		return key, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, keyURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponseStatus(resp); err != nil {
+		return nil, err
+	}
+
+	key, err := io.ReadAll(io.LimitReader(resp.Body, aes.BlockSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != aes.BlockSize {
+		return nil, &DecryptError{URL: keyURL, Reason: fmt.Sprintf("key has %d bytes instead of %d", len(key), aes.BlockSize)}
+	}
+
+	if e.keys.keys == nil {
+		e.keys.keys = make(map[string][]byte)
+	}
+	e.keys.keys[keyURL] = key
+	return key, nil
+}
+
+func (e *Engine) decryptSegment(ctx context.Context, seg mediaSegment, data []byte) ([]byte, error) {
+	key, err := e.getKey(ctx, seg.key.url)
+	if err != nil {
+		return nil, fmt.Errorf("fetch key of segment [%s]: %w", seg.name(), err)
+	}
+
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, &DecryptError{URL: seg.url, Reason: fmt.Sprintf("size %d isn't a multiple of the AES block size", len(data))}
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	cipher.NewCBCDecrypter(block, seg.key.iv).CryptBlocks(data, data)
+
+	// PKCS7 padding, a wrong key or IV shows up as broken padding
+	padding := int(data[len(data)-1])
+	if padding == 0 || padding > aes.BlockSize ||
+		!bytes.Equal(data[len(data)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, &DecryptError{URL: seg.url, Reason: "invalid padding, the key or IV doesn't match"}
+	}
+	return data[:len(data)-padding], nil
+}
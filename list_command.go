@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Eyevinn/hls-m3u8/m3u8"
+)
+
+type trailerListing struct {
+	AppID    string           `json:"app_id"`
+	AppName  string           `json:"app_name"`
+	ID       int              `json:"id"`
+	Name     string           `json:"name"`
+	Duration float64          `json:"duration_seconds"`
+	Variants []variantListing `json:"variants"`
+}
+
+type variantListing struct {
+	Resolution string         `json:"resolution"`
+	Bandwidth  uint32         `json:"bandwidth"`
+	Codecs     string         `json:"codecs"`
+	Container  string         `json:"container,omitempty"`
+	FrameRate  float64        `json:"frame_rate"`
+	Audio      []audioListing `json:"audio"`
+}
+
+type audioListing struct {
+	GroupID  string `json:"group_id"`
+	Name     string `json:"name"`
+	Language string `json:"language"`
+}
+
+func (a audioListing) String() string {
+	if a.Language == "" {
+		return a.GroupID
+	}
+	return fmt.Sprintf("%s (%s)", a.GroupID, a.Language)
+}
+
+// steam-query list [-format table|json|csv] <app-id or game page URL>...
+func runListCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	format := fs.String("format", "table", `output format: "table", "json" or "csv".`)
+	registerStoreFlags(fs)
+	fs.Parse(args)
+
+	if err := applyStoreFlags(); err != nil {
+		return err
+	}
+
+	client, err := newSteamClient(newHTTPClient())
+	if err != nil {
+		return err
+	}
+
+	appIDs, unresolved := resolveAppIDs(ctx, client, fs.Args())
+	for _, result := range unresolved {
+		fmt.Fprintf(os.Stderr, "skipping input [%s]: %v\n", result.appID, result.err)
+	}
+	if len(appIDs) == 0 {
+		return errors.New("didn't find any game page URL or steam app ID")
+	}
+
+	listings := make([]trailerListing, 0)
+	for _, appID := range appIDs {
+		appListings, err := listApp(ctx, appID)
+		if err != nil {
+			return fmt.Errorf("list app [%s]: %w", appID, err)
+		}
+		listings = append(listings, appListings...)
+	}
+
+	switch *format {
+	case "table":
+		return writeListingTable(os.Stdout, listings)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(listings)
+	case "csv":
+		return writeListingCSV(os.Stdout, listings)
+	default:
+		return fmt.Errorf("unknown output format [%s]", *format)
+	}
+}
+
+func listApp(ctx context.Context, appID string) ([]trailerListing, error) {
+	// listing never downloads segments, so the temporary files are never created
+	e, err := SetupFileManager(appID, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	details, err := e.getSteamAppDetails(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	listings := make([]trailerListing, 0, len(details.Trailers))
+	for _, trailer := range details.Trailers {
+		// progressive files only have the quality given by steam and their container
+		if len(getManifestSources(trailer, preferredManifest)) == 0 {
+			listing := trailerListing{AppID: appID, AppName: details.AppName, ID: trailer.ID, Name: trailer.Name, Variants: make([]variantListing, 0)}
+			for _, source := range getProgressiveSources(trailer) {
+				listing.Variants = append(listing.Variants, variantListing{Resolution: source.quality, Container: source.container})
+			}
+			listings = append(listings, listing)
+			continue
+		}
+
+		if err := e.loadTrailerManifest(ctx, trailer); err != nil {
+			return nil, fmt.Errorf("load manifest of trailer [%s]: %w", trailer, err)
+		}
+		sortVideoPlaylists(e.videoPlaylists)
+
+		listing := trailerListing{
+			AppID:    appID,
+			AppName:  details.AppName,
+			ID:       trailer.ID,
+			Name:     trailer.Name,
+			Variants: make([]variantListing, 0, len(e.videoPlaylists)),
+		}
+		for _, pl := range e.videoPlaylists {
+			listing.Duration = max(listing.Duration, pl.duration)
+			listing.Variants = append(listing.Variants, variantListing{
+				Resolution: pl.variant.Resolution,
+				Bandwidth:  pl.variant.Bandwidth,
+				Codecs:     pl.variant.Codecs,
+				FrameRate:  pl.variant.FrameRate,
+				Audio:      getAudioListings(pl.variant),
+			})
+		}
+		listings = append(listings, listing)
+	}
+	return listings, nil
+}
+
+func getAudioListings(variant *m3u8.Variant) []audioListing {
+	audio := make([]audioListing, 0)
+	for _, alt := range variant.Alternatives {
+		if alt.Type == "AUDIO" {
+			audio = append(audio, audioListing{GroupID: alt.GroupId, Name: alt.Name, Language: alt.Language})
+		}
+	}
+	return audio
+}
+
+func joinAudioListings(audio []audioListing) string {
+	names := make([]string, len(audio))
+	for i, a := range audio {
+		names[i] = a.String()
+	}
+	return strings.Join(names, ", ")
+}
+
+func writeListingTable(out io.Writer, listings []trailerListing) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, listing := range listings {
+		fmt.Fprintf(w, "%s (%s) - %s [id %d] %.1fs\n", listing.AppName, listing.AppID, listing.Name, listing.ID, listing.Duration)
+		fmt.Fprintln(w, "  RESOLUTION\tBANDWIDTH\tCODECS\tCONTAINER\tFPS\tAUDIO\t")
+		for _, v := range listing.Variants {
+			fmt.Fprintf(w, "  %s\t%d kbps\t%s\t%s\t%.2f\t%s\t\n", v.Resolution, v.Bandwidth/1000, v.Codecs, v.Container, v.FrameRate, joinAudioListings(v.Audio))
+		}
+	}
+	return w.Flush()
+}
+
+func writeListingCSV(out io.Writer, listings []trailerListing) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"app_id", "app_name", "trailer_id", "trailer_name", "duration_seconds", "resolution", "bandwidth", "codecs", "container", "frame_rate", "audio"})
+	for _, listing := range listings {
+		for _, v := range listing.Variants {
+			w.Write([]string{
+				listing.AppID,
+				listing.AppName,
+				strconv.Itoa(listing.ID),
+				listing.Name,
+				strconv.FormatFloat(listing.Duration, 'f', 3, 64),
+				v.Resolution,
+				strconv.FormatUint(uint64(v.Bandwidth), 10),
+				v.Codecs,
+				v.Container,
+				strconv.FormatFloat(v.FrameRate, 'f', 3, 64),
+				joinAudioListings(v.Audio),
+			})
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
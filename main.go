@@ -1,15 +1,15 @@
 package main
 
 import (
-	"cmp"
+	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"math"
+	"math/rand/v2"
 	"net/http"
 	"os"
 	"os/signal"
@@ -19,6 +19,7 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -27,33 +28,128 @@ import (
 )
 
 type SteamAppDetailsData struct {
-	Data SteamAppDetails `json:"data"`
+	Success bool            `json:"success"`
+	Data    SteamAppDetails `json:"data"`
 }
 
 type SteamAppDetails struct {
-	AppName  string        `json:"name"`
-	Trailers []TrailerData `json:"movies"`
+	AppName      string        `json:"name"`
+	RequiredAge  requiredAge   `json:"required_age"`
+	HeaderImage  string        `json:"header_image"`
+	CapsuleImage string        `json:"capsule_image"`
+	Background   string        `json:"background"`
+	Screenshots  []Screenshot  `json:"screenshots"`
+	Trailers     []TrailerData `json:"movies"`
 }
 
+// Movie entry from the appdetails "movies" payload.
 type TrailerData struct {
-	HLSManifest string `json:"hls_h264"`
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	Thumbnail string `json:"thumbnail"`
+	Highlight bool   `json:"highlight"`
+	// quality ("480", "max") => progressive file URL
+	MP4         map[string]string `json:"mp4"`
+	WebM        map[string]string `json:"webm"`
+	HLSManifest string            `json:"hls_h264"`
+	DashH264    string            `json:"dash_h264"`
+	DashAV1     string            `json:"dash_av1"`
+}
+
+// Describe the trailer to the user, so it's possible to tell which one is being chosen.
+func (t TrailerData) String() string {
+	desc := fmt.Sprintf("%s (id %d)", t.Name, t.ID)
+	if t.Highlight {
+		desc += " [highlight]"
+	}
+	return desc
 }
 
 var (
 	tmpAudioFile = "audio.m4s"
 	tmpVideoFile = "video.m4s"
-
-	steamApiURL = "https://store.steampowered.com/api/appdetails"
-
-	gamePagePattern = regexp.MustCompile("^https://store.steampowered.com/app/([0-9]+)/(.*)")
+	tmpStateFile = "resume.json"
+	// subtitles muxed into the output are written here first
+	tmpSubtitleFile = "subtitles.vtt"
 )
 
 var (
-	gamePageUrl string
-	outputDir   string
-	steamAppID  string
+	gamePageUrls   stringList
+	steamAppIDs    stringList
+	inputFile      string
+	jobs           int
+	outputDir      string
+	steamStoreURL  string
+	steamAPIURL    string
+	steamRateLimit float64
+	noCache        bool
+	nameQuery      string
+	countryCodes   string
+	storeLanguage  string
+	matureContent  bool
+	downloadAssets bool
+	manifestFlag   string
+	// manifest format tried first when the trailer has more than one
+	preferredManifest = HLSManifest
+	trailerSelector   string
+	qualityFlag       string
+	codecFlag         string
+	// video codecs tried in order when picking the trailer manifest
+	codecPreference = []VideoCodec{H264Codec, AV1Codec, HEVCCodec}
+	containerFlag   string
+	outputContainer = "mp4"
+	audioLangFlag   string
+	// audio languages tried in order, the default rendition is used when none matches
+	audioLanguages []string
+	allAudio       bool
+	subtitlesFlag  string
+	subtitleMode   = NoSubtitles
+	// segments of a file fetched at the same time
+	segmentConcurrency = 4
+	resumeDownloads    bool
+	// times a failed segment request is sent again, waiting longer after each failure
+	maxSegmentRetries = 3
+	retryBackoff      = 500 * time.Millisecond
+	// longest wait between retries of a failed segment
+	maxRetryBackoff = 30 * time.Second
+	// nil when the resolution should be prompted to the user
+	videoQuality *qualityPolicy
+	// stdin was read as the input file, so it can't answer prompts or terminal queries
+	stdinInput bool
 )
 
+// Flags of the steam store requests and of the trailer manifests, shared by the download and the
+// list commands.
+func registerStoreFlags(fs *flag.FlagSet) {
+	fs.StringVar(&steamStoreURL, "store-url", getEnvString("STEAM_STORE_URL", defaultSteamStoreURL), `base URL of the steam store API.`)
+	fs.StringVar(&countryCodes, "country", getEnvString("COUNTRY", ""), `country code sent to the steam API, e.g. "us". A comma separated list merges the trailers of every country.`)
+	fs.StringVar(&storeLanguage, "language", getEnvString("LANGUAGE", ""), `language sent to the steam API, e.g. "english", "french".`)
+	fs.BoolVar(&matureContent, "mature", getEnvString("MATURE_CONTENT", "") != "", `send the age check cookies, allowing trailers of mature titles.`)
+	fs.StringVar(&manifestFlag, "manifest", getEnvString("MANIFEST", string(HLSManifest)), `preferred trailer manifest: "hls" or "dash". The other one is used when the preferred is missing.`)
+	fs.Float64Var(&steamRateLimit, "rate-limit", defaultSteamRateLimit, `max requests per second sent to the steam store and web API, 0 disables the limit.`)
+	fs.BoolVar(&noCache, "no-cache", getEnvString("NO_CACHE", "") != "", `fetch app details and playlists from the server, without reading or writing the response cache.`)
+	fs.StringVar(&codecFlag, "codec", getEnvString("CODEC", "h264,av1,hevc"), `video codecs in order of preference, e.g. "av1,h264". Known codecs: "h264", "hevc" and "av1".`)
+}
+
+// Setup the rate limit, the response cache and the manifest preferences from the store flags.
+func applyStoreFlags() error {
+	configureSteamRateLimit(steamRateLimit)
+	setupResponseCache(noCache)
+
+	kind, err := parseManifestKind(manifestFlag)
+	if err != nil {
+		return err
+	}
+	preferredManifest = kind
+
+	codecs, err := parseCodecPreference(codecFlag)
+	if err != nil {
+		return err
+	}
+	codecPreference = codecs
+	return nil
+}
+
 func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(),
 		os.Interrupt,
@@ -62,102 +158,190 @@ func main() {
 		syscall.SIGKILL,
 		syscall.SIGTERM)
 
+	exitCode := 0
 	defer func() {
 		if err := recover(); err != nil {
 			log.Printf("Recovered from panic: %v\nStack Trace:\n%s", err, debug.Stack())
 		}
 
-		fmt.Println("removing temporary files...")
-		os.Remove(tmpAudioFile)
-		os.Remove(tmpVideoFile)
 		cancel()
+		os.Exit(exitCode)
 	}()
 
-	flag.StringVar(&gamePageUrl, "game-page", "", `url for steam game page.`)
+	if len(os.Args) > 1 {
+		var runCommand func(context.Context, []string) error
+		switch os.Args[1] {
+		case "list":
+			runCommand = runListCommand
+		case "search":
+			runCommand = runSearchCommand
+		case "cache":
+			runCommand = runCacheCommand
+		}
+
+		if runCommand != nil {
+			if err := runCommand(ctx, os.Args[2:]); err != nil {
+				fmt.Printf("Unexpected error: %+v\n", err)
+				exitCode = 1
+			}
+			return
+		}
+	}
+
+	registerStoreFlags(flag.CommandLine)
+	flag.Var(&gamePageUrls, "game-page", `url for steam game page. Can be repeated.`)
 	flag.StringVar(&outputDir, "output-dir", getEnvString("OUTPUT_DIR", "./"), `output directory of result file.`)
-	flag.StringVar(&steamAppID, "app-id", "", `steam app ID of the page game. (default: empty)`)
+	flag.Var(&steamAppIDs, "app-id", `steam app ID of the page game. Can be repeated. (default: empty)`)
+	flag.BoolVar(&downloadAssets, "assets", getEnvString("ASSETS", "") != "", `download the store header, capsule, background and screenshots along the trailers.`)
+	flag.StringVar(&nameQuery, "name", getEnvString("GAME_NAME", ""), `app name searched on the cached steam app list, prompting when there's more than one candidate.`)
+	flag.StringVar(&steamAPIURL, "api-url", getEnvString("STEAM_API_URL", defaultSteamAPIURL), `base URL of the steam web API, used to download the app list.`)
+	flag.StringVar(&inputFile, "input-file", "", `file with one steam app ID or game page URL per line, "-" reads from stdin.`)
+	flag.IntVar(&jobs, "jobs", 2, `max number of apps processed at the same time.`)
+	flag.IntVar(&maxSegmentRetries, "retries", maxSegmentRetries, `max number of times a failed segment download is retried.`)
+	flag.DurationVar(&retryBackoff, "retry-backoff", retryBackoff, `wait before the first segment retry, doubled on each following one.`)
+	flag.BoolVar(&resumeDownloads, "resume", getEnvString("RESUME", "") != "", `resume the trailer download left by a killed or failed run, keeping its trailer and variant.`)
+	flag.IntVar(&segmentConcurrency, "concurrency", segmentConcurrency, `max number of segments of each trailer downloaded at the same time, shared by its video and audio files.`)
+	flag.StringVar(&trailerSelector, "trailer", getEnvString("TRAILER", ""), `trailer selector: index, "first", "all" or a regex matched against the trailer name. (default: interactive prompt)`)
+	flag.StringVar(&qualityFlag, "quality", getEnvString("QUALITY", ""), `video quality policy, e.g. "best", "worst", "1280x720", "<=1080p,codec=avc1,fps<=30". (default: interactive prompt)`)
+	flag.StringVar(&containerFlag, "container", getEnvString("CONTAINER", "mp4"), `output container: "mp4", "mkv" or "webm".`)
+	flag.StringVar(&audioLangFlag, "audio-lang", getEnvString("AUDIO_LANG", ""), `audio languages in order of preference, e.g. "pt-BR,en". (default: the default audio track)`)
+	flag.BoolVar(&allAudio, "all-audio", getEnvString("ALL_AUDIO", "") != "", `mux every audio track of the chosen variant into the output, tagged with its language.`)
+	flag.StringVar(&subtitlesFlag, "subtitles", getEnvString("SUBTITLES", string(NoSubtitles)), `WebVTT subtitles of the chosen variant: "none", "sidecar" (.vtt files next to the output) or "mux" (tracks on the output).`)
 	flag.Parse()
 
-	if gamePageUrl == "" {
-		gamePageUrl = getEnvString("GAME_PAGE", "")
+	if err := applyStoreFlags(); err != nil {
+		log.Fatal(err)
+	}
+
+	if segmentConcurrency < 1 {
+		log.Fatal("concurrency must be at least 1")
+	}
+
+	container, err := parseContainer(containerFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	outputContainer = container
+	audioLanguages = parseAudioLanguages(audioLangFlag)
+
+	mode, err := parseSubtitleMode(subtitlesFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	subtitleMode = mode
+
+	if qualityFlag != "" {
+		policy, err := parseQualityPolicy(qualityFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		videoQuality = policy
+	}
+
+	inputs := slices.Concat(steamAppIDs, gamePageUrls, flag.Args())
+	if inputFile != "" {
+		lines, err := readInputFile(inputFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		inputs = append(inputs, lines...)
+		stdinInput = inputFile == "-"
 	}
 
-	if gamePageUrl != "" {
-		appId, err := getSteamAppID(gamePageUrl)
+	if nameQuery != "" {
+		appID, err := resolveAppName(ctx, nameQuery)
 		if err != nil {
 			log.Fatal(err)
 		}
-		steamAppID = appId
+		inputs = append(inputs, appID)
 	}
 
-	if steamAppID == "" {
+	if len(inputs) == 0 {
+		if gamePageUrl := getEnvString("GAME_PAGE", ""); gamePageUrl != "" {
+			inputs = append(inputs, gamePageUrl)
+		}
+	}
+
+	client, err := newSteamClient(newHTTPClient())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	appIDs, unresolved := resolveAppIDs(ctx, client, inputs)
+	if len(appIDs) == 0 && len(unresolved) == 0 {
 		fmt.Println("didn't find any game page URL or steam app ID")
 		return
 	}
 
-	g, ctx := errgroup.WithContext(ctx)
-	g.Go(func() error {
-		return runApp(ctx, steamAppID)
-	})
-	if err := g.Wait(); err != nil {
-		fmt.Printf("Unexpected error: %+v\n", err)
+	// prompts can't be shared between apps running at the same time
+	if jobs > 1 && (trailerSelector == "" || videoQuality == nil) {
+		jobs = 1
+	}
+
+	results := append(unresolved, runBatch(ctx, appIDs, jobs)...)
+	if failed := printBatchSummary(results); failed > 0 {
+		exitCode = 1
 	}
 }
 
-func runApp(ctx context.Context, steamAppID string) error {
-	fm, err := SetupFileManager(steamAppID, tmpVideoFile, tmpAudioFile)
+func runApp(ctx context.Context, steamAppID string) appResult {
+	// temporary files are named after each downloaded trailer
+	fm, err := SetupFileManager(steamAppID, "", "")
 	if err != nil {
-		return fmt.Errorf("setup file manager: %w", err)
+		return appResult{appID: steamAppID, err: fmt.Errorf("setup file manager: %w", err)}
 	}
 
-	if err := fm.extractMasterPlaylists(ctx); err != nil {
-		return fmt.Errorf("extract master playlists: %w", err)
+	// temporary files of a failed download are kept along its state, so it can be resumed
+	err = fm.downloadApp(ctx)
+	if _, statErr := os.Stat(fm.stateFileName); err != nil && statErr == nil {
+		err = fmt.Errorf("%w (run again with -resume to continue)", err)
+	} else {
+		fm.removeTempFiles()
 	}
+	return appResult{appID: steamAppID, retries: int(fm.segmentRetries.Load()), err: err}
+}
 
-	//TODO: make generic helper to map new files
-	getFileNames := func(m *m3u8.MediaPlaylist) []string {
-		fileNames := make([]string, 0)
-		fileNames = append(fileNames, m.Map.URI)
-		for _, seg := range m.Segments {
-			if seg != nil {
-				fileNames = append(fileNames, seg.URI)
-			}
+// Download the chosen trailers of the app, and its assets when asked.
+func (e *Engine) downloadApp(ctx context.Context) error {
+	appDetails, err := e.getSteamAppDetails(ctx)
+	if err != nil {
+		var ageGateErr *AgeGateError
+		if errors.As(err, &ageGateErr) && !matureContent {
+			return fmt.Errorf("get app details: %w (run again with -mature)", err)
 		}
-		return fileNames
+		return fmt.Errorf("get app details: %w", err)
 	}
 
-	videoPl, err := chooseResolution(ctx, fm.videoPlaylists)
-	if err != nil {
-		return err
+	selector := trailerSelector
+	if resumeDownloads && selector == "" {
+		selector = e.getResumedTrailerSelector(appDetails.Trailers)
 	}
 
-	w, err := SetupWindowTable()
+	trailers, err := chooseVideoPlaylist(ctx, appDetails, selector)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("choose trailer: %w", err)
 	}
-	defer w.Close()
 
-	fm.win = w
-	w.RefreshRoutine(ctx)
+	for _, trailer := range trailers {
+		e.setupTrailerFiles(trailer.ID)
 
-	g, ctx := errgroup.WithContext(ctx)
-	g.Go(func() error {
-		return fm.mergeAndWriteFile(ctx, fm.outputVideoFile, getFileNames(videoPl)...)
-	})
-	g.Go(func() error {
-		return fm.mergeAndWriteFile(ctx, fm.outputAudioFile, getFileNames(fm.audioPlaylist)...)
-	})
-	if err := g.Wait(); err != nil {
-		return fmt.Errorf("writing temp files: %w", err)
-	}
+		outputName := getOutputFileName(e.steamAppId, appDetails, trailer)
+		metadata := map[string]string{
+			"title":   trailer.Name,
+			"album":   appDetails.AppName,
+			"comment": fmt.Sprintf("steam app %s, movie %d", e.steamAppId, trailer.ID),
+		}
 
-	outputPath, err := validateOutputPath(outputDir)
-	if err != nil {
-		return fmt.Errorf("output path validation: %w", err)
+		if err := e.downloadTrailer(ctx, trailer, outputName, metadata); err != nil {
+			return fmt.Errorf("download trailer [%s]: %w", trailer, err)
+		}
+		e.removeTempFiles()
 	}
 
-	if err := TransformMedia(tmpVideoFile, tmpAudioFile, outputPath); err != nil {
-		return fmt.Errorf("transforming to output format: %w", err)
+	if downloadAssets {
+		if err := e.downloadAssets(ctx, appDetails); err != nil {
+			return fmt.Errorf("download assets: %w", err)
+		}
 	}
 	return nil
 }
@@ -166,25 +350,31 @@ func runApp(ctx context.Context, steamAppID string) error {
  * Helper functions
  */
 
-func chooseResolution(ctx context.Context, playlists []*videoPlaylist) (*m3u8.MediaPlaylist, error) {
-	fmt.Println("Select output resolution option:")
+func chooseResolution(ctx context.Context, playlists []*videoPlaylist, policy *qualityPolicy) (*videoPlaylist, error) {
+	if len(playlists) == 0 {
+		return nil, errors.New("master playlist doesn't have any video variant")
+	}
 
-	// sort playlist by resolution
-	slices.SortFunc(playlists, func(a, b *videoPlaylist) int {
-		aNumber, _ := strconv.Atoi(strings.SplitN(a.resolution, "x", 1)[0])
-		bNumber, _ := strconv.Atoi(strings.SplitN(b.resolution, "x", 1)[0])
+	sortVideoPlaylists(playlists)
 
-		return cmp.Compare(aNumber, bNumber)
-	})
+	if policy != nil {
+		selected, err := policy.selectVariant(playlists)
+		if err != nil {
+			return nil, err
+		}
+		return selected, nil
+	}
+
+	fmt.Println("Select output resolution option:")
 	for i, pl := range playlists {
-		fmt.Printf(" [%d] %s\n", i+1, pl.resolution)
+		fmt.Printf(" [%d] %s (%d kbps, %s)\n", i+1, pl.variant.Resolution, pl.variant.Bandwidth/1000, pl.variant.Codecs)
 	}
 
 	selectedIdx, err := getInputNumber(ctx, 1, len(playlists))
 	if err != nil {
 		return nil, err
 	}
-	return playlists[selectedIdx-1].playlist, nil
+	return playlists[selectedIdx-1], nil
 }
 
 func getCursorPos() (row int, col int, err error) {
@@ -197,16 +387,7 @@ func getCursorPos() (row int, col int, err error) {
 	return row, col, nil
 }
 
-func getSteamAppID(url string) (string, error) {
-	matches := gamePagePattern.FindStringSubmatch(url)
-	if len(matches) < 2 {
-		return "", errors.New("didn't find any matches for page URL")
-	}
-
-	return matches[1], nil
-}
-
-func validateOutputPath(outPath string) (string, error) {
+func validateOutputPath(outPath, fileName string) (string, error) {
 	outPath = path.Clean(outPath)
 	info, err := os.Stat(outPath)
 	if err != nil {
@@ -217,7 +398,33 @@ func validateOutputPath(outPath string) (string, error) {
 		return "", errors.New("can't use provide directory")
 	}
 
-	return path.Join(outPath, "output.mp4"), nil
+	return path.Join(outPath, fileName), nil
+}
+
+var invalidFileNameChars = regexp.MustCompile(`[<>:"/\\|?*\x00-\x1f]+`)
+
+// Output files are named as "<app name> - <trailer name> [<movie id>].<container>", the movie ID
+// keeps trailers sharing the same name apart.
+func getOutputFileName(steamAppID string, details SteamAppDetails, trailer TrailerData) string {
+	appName := getAppBaseName(steamAppID, details)
+
+	trailerName := sanitizeFileName(trailer.Name)
+	if trailerName == "" {
+		return fmt.Sprintf("%s [%d].%s", appName, trailer.ID, outputContainer)
+	}
+	return fmt.Sprintf("%s - %s [%d].%s", appName, trailerName, trailer.ID, outputContainer)
+}
+
+func getAppBaseName(steamAppID string, details SteamAppDetails) string {
+	if appName := sanitizeFileName(details.AppName); appName != "" {
+		return appName
+	}
+	return steamAppID
+}
+
+func sanitizeFileName(name string) string {
+	name = invalidFileNameChars.ReplaceAllString(name, " ")
+	return strings.Trim(strings.Join(strings.Fields(name), " "), ". ")
 }
 
 func getEnvString(name string, dft ...string) string {
@@ -235,6 +442,10 @@ func getEnvString(name string, dft ...string) string {
 // and will not be able to handle SIGINT signals.
 // Search for an approach which allow us to cancel the read IO operation and gracefully shutdown the CLI.
 func getInputNumber(ctx context.Context, start, end int) (int, error) {
+	if stdinInput {
+		return 0, errors.New("can't prompt for an option, stdin was read as the input file (use -trailer and -quality)")
+	}
+
 	var optionNumber int
 	for {
 		select {
@@ -243,6 +454,9 @@ func getInputNumber(ctx context.Context, start, end int) (int, error) {
 		default:
 			fmt.Print("> ")
 			nArgs, err := fmt.Scanf("%d\n", &optionNumber)
+			if errors.Is(err, io.EOF) {
+				return 0, fmt.Errorf("read option: %w", err)
+			}
 			if err == nil && nArgs == 1 && optionNumber <= end && optionNumber >= start {
 				return optionNumber, nil
 			}
@@ -251,17 +465,59 @@ func getInputNumber(ctx context.Context, start, end int) (int, error) {
 	}
 }
 
-func chooseVideoPlaylist(ctx context.Context, details SteamAppDetails) (TrailerData, error) {
+func chooseVideoPlaylist(ctx context.Context, details SteamAppDetails, selector string) ([]TrailerData, error) {
+	if len(details.Trailers) == 0 {
+		return nil, errors.New("app doesn't have any trailer")
+	}
+
+	if selector != "" {
+		return selectTrailers(details.Trailers, selector)
+	}
+
 	fmt.Println("Select which video from the page you with download:")
-	for i, _ := range details.Trailers {
-		fmt.Printf("[%d] %dº video\n", i+1, i+1)
+	for i, trailer := range details.Trailers {
+		fmt.Printf("[%d] %s\n", i+1, trailer)
 	}
 
 	selectedIdx, err := getInputNumber(ctx, 1, len(details.Trailers))
 	if err != nil {
-		return TrailerData{}, err
+		return nil, err
+	}
+	return details.Trailers[selectedIdx-1 : selectedIdx], nil
+}
+
+// Select trailers without prompting the user. The selector can be an index (starting from 1),
+// "first", "all" or a regex matched against the trailer name.
+func selectTrailers(trailers []TrailerData, selector string) ([]TrailerData, error) {
+	switch selector {
+	case "first":
+		return trailers[:1], nil
+	case "all":
+		return trailers, nil
+	}
+
+	if idx, err := strconv.Atoi(selector); err == nil {
+		if idx < 1 || idx > len(trailers) {
+			return nil, fmt.Errorf("trailer index [%d] out of range, app has %d trailers", idx, len(trailers))
+		}
+		return trailers[idx-1 : idx], nil
+	}
+
+	pattern, err := regexp.Compile(selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trailer selector [%s]: %w", selector, err)
+	}
+
+	selected := make([]TrailerData, 0)
+	for _, trailer := range trailers {
+		if pattern.MatchString(trailer.Name) {
+			selected = append(selected, trailer)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no trailer matches selector [%s]", selector)
 	}
-	return details.Trailers[selectedIdx-1], nil
+	return selected, nil
 }
 
 /**
@@ -269,189 +525,521 @@ func chooseVideoPlaylist(ctx context.Context, details SteamAppDetails) (TrailerD
  */
 
 type videoPlaylist struct {
-	resolution string
-	playlist   *m3u8.MediaPlaylist
+	variant  *m3u8.Variant
+	segments []mediaSegment
+	// seconds
+	duration float64
 }
 
 type Engine struct {
-	steamAppId       string
-	basePlaylistsUrl string
+	steamAppId string
 	// resolution => Media Playlist Metadata
-	videoPlaylists  []*videoPlaylist
-	audioPlaylist   *m3u8.MediaPlaylist
-	outputVideoFile *os.File
-	outputAudioFile *os.File
-	httpClient      *http.Client
-	win             *windowTable
+	videoPlaylists     []*videoPlaylist
+	audioRenditions    []*rendition
+	subtitleRenditions []*rendition
+	videoCodec         VideoCodec
+	videoFileName      string
+	// names of the first audio and subtitle track files, the other tracks are numbered after them
+	audioFileName    string
+	subtitleFileName string
+	// every track file written by the engine, removed along the other temporary files
+	trackFileNames   []string
+	outputVideoFile  *os.File
+	outputAudioFiles []*os.File
+	stateFileName    string
+	httpClient       *http.Client
+	steamClient      *SteamClient
+	win              *windowTable
+	// same as httpClient without the request timeout, for files taking longer than it to download
+	fileClient *http.Client
+	// segment requests sent again after failing, on every trailer of the app
+	segmentRetries atomic.Int64
+	// keys of encrypted segments
+	keys keyCache
+	// segmentConcurrency workers shared by every file of the trailer, bounding its connections
+	segmentWorkers chan struct{}
 }
 
-func SetupFileManager(steamAppId string, videoOutputFile, audioOutputFile string) (*Engine, error) {
-	vF, err := os.OpenFile(videoOutputFile, os.O_CREATE|os.O_RDWR, os.ModePerm)
-	if err != nil {
-		return nil, err
+func newHTTPClient() *http.Client {
+	// video and audio segments are fetched at the same time, sharing the same pool of workers
+	maxConns := max(10, segmentConcurrency)
+	return &http.Client{
+		Transport: &rateLimitedTransport{
+			base: &http.Transport{
+				MaxIdleConns:        maxConns,
+				MaxIdleConnsPerHost: maxConns,
+				MaxConnsPerHost:     maxConns,
+				IdleConnTimeout:     time.Second * 10,
+			},
+			limiter: rateLimiter,
+		},
+		Timeout: time.Minute * 1,
+	}
+}
+
+func newSteamClient(httpClient *http.Client) (*SteamClient, error) {
+	client := NewSteamClient(steamStoreURL, httpClient)
+	client.SetCache(responseCache)
+	if matureContent {
+		if err := client.AllowMatureContent(); err != nil {
+			return nil, err
+		}
 	}
+	return client, nil
+}
 
-	aF, err := os.OpenFile(audioOutputFile, os.O_CREATE|os.O_RDWR, os.ModePerm)
+func SetupFileManager(steamAppId string, videoOutputFile, audioOutputFile string) (*Engine, error) {
+	c := newHTTPClient()
+	steamClient, err := newSteamClient(c)
 	if err != nil {
 		return nil, err
 	}
 
-	c := &http.Client{
-		Transport: &http.Transport{
-			MaxIdleConns:        10,
-			MaxIdleConnsPerHost: 10,
-			MaxConnsPerHost:     10,
-			IdleConnTimeout:     time.Second * 10,
-		},
-		Timeout: time.Minute * 1,
-	}
+	fileClient := *c
+	fileClient.Timeout = 0
 
 	return &Engine{
-		steamAppId:      steamAppId,
-		outputVideoFile: vF,
-		outputAudioFile: aF,
-		httpClient:      c,
+		steamAppId:    steamAppId,
+		videoFileName: videoOutputFile,
+		audioFileName: audioOutputFile,
+		httpClient:    c,
+		fileClient:    &fileClient,
+		steamClient:   steamClient,
+		// workers are only taken while fetching, so files never wait on each other to be written
+		segmentWorkers: make(chan struct{}, segmentConcurrency),
 	}, nil
 }
 
-func (e *Engine) mergeAndWriteFile(ctx context.Context, f io.WriteCloser, fileNames ...string) error {
-	defer f.Close()
-
-	progress := NewProgressLine()
-	_, err := e.win.addLine(progress.Blocks()...)
+// Temporary files are truncated to the given offsets on every open, dropping anything a previous
+// run wrote past them. Offsets are zero unless a previous download is resumed. Each audio track has
+// its own file.
+func (e *Engine) openTempFiles(videoOffset int64, audioOffsets []int64) error {
+	vF, err := openTruncatedFile(e.videoFileName, videoOffset)
 	if err != nil {
 		return err
 	}
 
-	// rounding to above them we will always have bar completed
-	// TODO: think another way to have the progress bar and total of items synced
-	stepPercentage := int(math.Ceil((1.0 / float64(len(fileNames))) * 100.0))
+	audioFiles := make([]*os.File, 0, len(audioOffsets))
+	for i, offset := range audioOffsets {
+		name := e.addTrackFile(e.audioFileName, i)
 
-	for _, name := range fileNames {
-		progress.UpdateInfo(fmt.Sprintf("Downloading %s", name))
-
-		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/%s", e.basePlaylistsUrl, name), nil)
+		aF, err := openTruncatedFile(name, offset)
 		if err != nil {
+			vF.Close()
+			for _, f := range audioFiles {
+				f.Close()
+			}
 			return err
 		}
+		audioFiles = append(audioFiles, aF)
+	}
 
-		resp, err := e.httpClient.Do(req)
+	e.outputVideoFile = vF
+	e.outputAudioFiles = audioFiles
+	return nil
+}
+
+// Open the file for writing at the given offset, dropping every byte after it.
+func openTruncatedFile(name string, offset int64) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Name of the i-th track file, recorded so it's removed along the other temporary files.
+func (e *Engine) addTrackFile(base string, i int) string {
+	name := getTrackFileName(base, i)
+	if !slices.Contains(e.trackFileNames, name) {
+		e.trackFileNames = append(e.trackFileNames, name)
+	}
+	return name
+}
+
+// Apps may run at the same time and a resumed run may continue any of their trailers, so each
+// trailer has its own temporary files and resume state.
+func (e *Engine) setupTrailerFiles(trailerID int) {
+	e.videoFileName = getTrailerTempFileName(e.steamAppId, trailerID, tmpVideoFile)
+	e.audioFileName = getTrailerTempFileName(e.steamAppId, trailerID, tmpAudioFile)
+	e.subtitleFileName = getTrailerTempFileName(e.steamAppId, trailerID, tmpSubtitleFile)
+	e.stateFileName = getTrailerTempFileName(e.steamAppId, trailerID, tmpStateFile)
+	e.trackFileNames = nil
+}
+
+func getTrailerTempFileName(steamAppID string, trailerID int, name string) string {
+	return fmt.Sprintf("%s_%d_%s", steamAppID, trailerID, name)
+}
+
+func (e *Engine) removeTempFiles() {
+	os.Remove(e.videoFileName)
+	os.Remove(e.audioFileName)
+	for _, name := range e.trackFileNames {
+		os.Remove(name)
+	}
+	os.Remove(e.stateFileName)
+}
+
+func (e *Engine) downloadTrailer(ctx context.Context, trailer TrailerData, outputName string, metadata map[string]string) error {
+	if len(getManifestSources(trailer, preferredManifest)) == 0 {
+		return e.downloadProgressiveTrailer(ctx, trailer, outputName, metadata)
+	}
+
+	if err := e.loadTrailerManifest(ctx, trailer); err != nil {
+		return fmt.Errorf("load trailer manifest: %w", err)
+	}
+
+	if err := validateContainerCodec(outputContainer, e.videoCodec); err != nil {
+		return err
+	}
+
+	// the variant chosen by the last run is kept when resuming it
+	previous := e.getPreviousResumeState(trailer.ID)
+	videoPl := findResumedVariant(previous, e.videoPlaylists)
+	if videoPl == nil {
+		var err error
+		videoPl, err = chooseResolution(ctx, e.videoPlaylists, videoQuality)
 		if err != nil {
 			return err
 		}
+	}
 
-		_, err = io.Copy(f, resp.Body)
-		if err != nil {
-			resp.Body.Close()
-			return err
+	audio, err := selectAudioRenditions(videoPl, e.audioRenditions, audioLanguages, allAudio)
+	if err != nil {
+		return err
+	}
+
+	if err := validateVariantCodecs(outputContainer, videoPl.variant, e.videoCodec); err != nil {
+		return err
+	}
+
+	state := e.setupResumeState(previous, trailer.ID, videoPl, audio)
+	audioOffsets := make([]int64, len(state.Audio))
+	for i := range state.Audio {
+		audioOffsets[i] = state.Audio[i].lastOffset()
+	}
+	if err := e.openTempFiles(state.Video.lastOffset(), audioOffsets); err != nil {
+		return fmt.Errorf("open temp files: %w", err)
+	}
+
+	w, err := AcquireWindowTable()
+	if err != nil {
+		return fmt.Errorf("setup window table: %w", err)
+	}
+	defer ReleaseWindowTable()
+
+	e.win = w
+
+	g, gCtx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		return e.mergeAndWriteFile(gCtx, e.outputVideoFile, func(size int) error {
+			return state.markWritten(&state.Video, size)
+		}, videoPl.segments[len(state.Video.Offsets):]...)
+	})
+	for i, r := range audio {
+		fileState := &state.Audio[i]
+		g.Go(func() error {
+			return e.mergeAndWriteFile(gCtx, e.outputAudioFiles[i], func(size int) error {
+				return state.markWritten(fileState, size)
+			}, r.segments[len(fileState.Offsets):]...)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return fmt.Errorf("writing temp files: %w", err)
+	}
+
+	outputPath, err := validateOutputPath(outputDir, outputName)
+	if err != nil {
+		return fmt.Errorf("output path validation: %w", err)
+	}
+
+	inputs := []MediaInput{{File: e.videoFileName}}
+	for i, r := range audio {
+		inputs = append(inputs, MediaInput{File: getTrackFileName(e.audioFileName, i), StreamMetadata: getStreamMetadata(r)})
+	}
+
+	// variants without SUBTITLES group don't get the subtitles of other variants
+	subtitles := getGroupRenditions(videoPl.variant.Subtitles, e.subtitleRenditions)
+	subtitleFiles := make([][]byte, len(subtitles))
+	for i, r := range subtitles {
+		if subtitleFiles[i], err = e.downloadSubtitles(ctx, r); err != nil {
+			return fmt.Errorf("download subtitles [%s]: %w", r.uri, err)
 		}
-		resp.Body.Close()
 
-		progress.Progress(stepPercentage)
+		if subtitleMode == MuxedSubtitles {
+			name := e.addTrackFile(e.subtitleFileName, i)
+			if err := os.WriteFile(name, subtitleFiles[i], 0o644); err != nil {
+				return fmt.Errorf("write subtitles [%s]: %w", name, err)
+			}
+			inputs = append(inputs, MediaInput{File: name, StreamMetadata: getStreamMetadata(r)})
+		}
+	}
+
+	if err := TransformMedia(outputPath, metadata, inputs...); err != nil {
+		return fmt.Errorf("transforming to output format: %w", err)
 	}
+
+	if subtitleMode == SidecarSubtitles {
+		if err := writeSidecarSubtitles(outputPath, subtitles, subtitleFiles); err != nil {
+			return err
+		}
+	}
+
+	state.remove()
 	return nil
 }
 
-func (e *Engine) extractMasterPlaylists(ctx context.Context) error {
-	masterpl, err := e.selectMasterPlaylist(ctx)
+// Segments are fetched by the workers of the engine and written in playlist order. Fetched
+// segments wait on a reorder buffer until every segment before them is written, the buffer is
+// bounded so a slow segment doesn't keep the whole trailer in memory. The size of each written
+// segment is reported to onWritten, recording the download progress.
+func (e *Engine) mergeAndWriteFile(ctx context.Context, f io.WriteCloser, onWritten func(size int) error, segments ...mediaSegment) error {
+	defer f.Close()
+
+	if len(segments) == 0 {
+		return nil
+	}
+
+	progress := NewProgressLine()
+	_, err := e.win.addLine(progress.Blocks()...)
 	if err != nil {
 		return err
 	}
 
-	// setup video playlist variants by resolution
-	for _, variant := range masterpl.Variants {
-		if pl, err := e.downloadAndDecodeM3U8File(ctx, variant.URI); err == nil {
-			e.videoPlaylists = append(e.videoPlaylists, &videoPlaylist{
-				resolution: variant.Resolution,
-				playlist:   pl.(*m3u8.MediaPlaylist),
+	// rounding to above them we will always have bar completed
+	// TODO: think another way to have the progress bar and total of items synced
+	stepPercentage := int(math.Ceil((1.0 / float64(len(segments))) * 100.0))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	fetched := make([]chan []byte, len(segments))
+	for i := range fetched {
+		fetched[i] = make(chan []byte, 1)
+	}
+	// retries of this file only, the engine counts the ones of every file
+	var retries atomic.Int64
+	workers := e.segmentWorkers
+	reorderBuffer := make(chan struct{}, 2*segmentConcurrency)
+
+	g, gCtx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		for i, seg := range segments {
+			// a slot on the buffer is taken before fetching, and released once the segment is written
+			select {
+			case reorderBuffer <- struct{}{}:
+			case <-gCtx.Done():
+				return nil
+			}
+			select {
+			case workers <- struct{}{}:
+			case <-gCtx.Done():
+				return nil
+			}
+
+			g.Go(func() error {
+				defer func() { <-workers }()
+
+				data, err := e.fetchSegmentWithRetry(gCtx, seg, func() {
+					e.segmentRetries.Add(1)
+					progress.UpdateInfo(fmt.Sprintf("Retrying %s (%d retries)", seg.name(), retries.Add(1)))
+				})
+				if err != nil {
+					return fmt.Errorf("segment [%s]: %w", seg.name(), err)
+				}
+				fetched[i] <- data
+				return nil
 			})
-		} else {
-			return err
 		}
-	}
+		return nil
+	})
 
-	for _, alt := range masterpl.GetAllAlternatives() {
-		if alt.Type == "AUDIO" {
-			if pl, err := e.downloadAndDecodeM3U8File(ctx, alt.URI); err == nil {
-				e.audioPlaylist = pl.(*m3u8.MediaPlaylist)
-				break
-			} else {
+	for i, seg := range segments {
+		var data []byte
+		select {
+		case data = <-fetched[i]:
+		case <-gCtx.Done():
+			// the failed worker error is returned by Wait
+			if err := g.Wait(); err != nil {
 				return err
 			}
+			return gCtx.Err()
 		}
-	}
 
-	return nil
-}
+		if _, err := f.Write(data); err != nil {
+			cancel()
+			g.Wait()
+			return err
+		}
+		if err := onWritten(len(data)); err != nil {
+			cancel()
+			g.Wait()
+			return fmt.Errorf("save resume state: %w", err)
+		}
+		<-reorderBuffer
 
-func (e *Engine) selectMasterPlaylist(ctx context.Context) (*m3u8.MasterPlaylist, error) {
-	appDetails, err := e.getSteamAppDetails(ctx)
-	if err != nil {
-		return nil, err
+		info := fmt.Sprintf("Downloaded %s", seg.name())
+		if n := retries.Load(); n > 0 {
+			info += fmt.Sprintf(" (%d retries)", n)
+		}
+		progress.UpdateInfo(info)
+		progress.Progress(stepPercentage)
 	}
+	return g.Wait()
+}
 
-	selectedTrailer, err := chooseVideoPlaylist(ctx, appDetails)
-	if err != nil {
-		return nil, err
+// Failed requests are sent again with exponential backoff, up to maxSegmentRetries times. Errors
+// that would fail again, like a missing segment, are returned at once.
+func (e *Engine) fetchSegmentWithRetry(ctx context.Context, seg mediaSegment, onRetry func()) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		data, err := e.fetchSegment(ctx, seg)
+		if err == nil || attempt >= maxSegmentRetries || ctx.Err() != nil || !isRetryableError(err) {
+			return data, err
+		}
+
+		onRetry()
+		if err := sleepContext(ctx, getRetryBackoff(attempt)); err != nil {
+			return nil, err
+		}
 	}
+}
 
-	// extract base url and master playlist name
-	// https://host/path/to/app/hls_264_master.m3u8?t=1733940241
-	lastSlashIdx := strings.LastIndex(selectedTrailer.HLSManifest, "/")
-	questionMarkIndex := strings.Index(selectedTrailer.HLSManifest, "?")
+// Server errors and timeouts are retried, other HTTP statuses and segments failing to decrypt
+// aren't. Other errors are network failures, so they're retried too.
+func isRetryableError(err error) bool {
+	var decryptErr *DecryptError
+	if errors.As(err, &decryptErr) {
+		return false
+	}
 
-	e.basePlaylistsUrl = selectedTrailer.HLSManifest[:lastSlashIdx]
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 ||
+			statusErr.StatusCode == http.StatusRequestTimeout ||
+			statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
 
-	playlist, err := e.downloadAndDecodeM3U8File(ctx, selectedTrailer.HLSManifest[lastSlashIdx+1:questionMarkIndex])
-	if err != nil {
-		return nil, err
+// Backoff doubles on each attempt, with a random jitter of up to half of it so workers failing at
+// the same time don't retry at the same time.
+func getRetryBackoff(attempt int) time.Duration {
+	if retryBackoff <= 0 {
+		return 0
 	}
 
-	return playlist.(*m3u8.MasterPlaylist), nil
+	// doubling stops at the limit, so high attempts never overflow
+	backoff := retryBackoff
+	for i := 0; i < attempt && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, maxRetryBackoff)
+	return backoff/2 + rand.N(backoff/2+1)
 }
 
-func (e *Engine) downloadAndDecodeM3U8File(ctx context.Context, fileName string) (m3u8.Playlist, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/%s", e.basePlaylistsUrl, fileName), nil)
+// The whole segment is read before being written, so a failed request never leaves part of it on
+// the output file.
+func (e *Engine) fetchSegment(ctx context.Context, seg mediaSegment) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, seg.url, nil)
 	if err != nil {
 		return nil, err
 	}
+	if seg.length > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", seg.offset, seg.offset+seg.length-1))
+	}
 
 	resp, err := e.httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
-
 	defer resp.Body.Close()
-	paylist, _, err := m3u8.DecodeFrom(resp.Body, false)
+
+	body := io.Reader(resp.Body)
+	switch {
+	case seg.length > 0 && resp.StatusCode == http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", seg.offset)) {
+			return nil, fmt.Errorf("requested range starting at %d, got [%s]", seg.offset, resp.Header.Get("Content-Range"))
+		}
+		body = io.LimitReader(resp.Body, seg.length)
+	case seg.length > 0 && resp.StatusCode == http.StatusOK:
+		// servers ignoring the range answer with the whole file
+		if _, err := io.CopyN(io.Discard, resp.Body, seg.offset); err != nil {
+			return nil, err
+		}
+		body = io.LimitReader(resp.Body, seg.length)
+	default:
+		if err := checkResponseStatus(resp); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := io.ReadAll(body)
 	if err != nil {
 		return nil, err
 	}
-	return paylist, nil
+	if seg.length > 0 && int64(len(data)) != seg.length {
+		return nil, fmt.Errorf("got %d bytes of a %d bytes range", len(data), seg.length)
+	}
+
+	if seg.key == nil {
+		return data, nil
+	}
+	return e.decryptSegment(ctx, seg, data)
 }
 
-func (e *Engine) getSteamAppDetails(ctx context.Context) (SteamAppDetails, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s?appids=%s", steamApiURL, steamAppID), nil)
+// The manifest URL is requested as it is, keeping the query token steam signs it with.
+func (e *Engine) selectMasterPlaylist(ctx context.Context, manifestURL string) (*m3u8.MasterPlaylist, error) {
+	playlist, err := e.downloadAndDecodeM3U8File(ctx, manifestURL)
 	if err != nil {
-		return SteamAppDetails{}, err
+		return nil, err
 	}
 
-	resp, err := e.httpClient.Do(req)
+	masterpl, ok := playlist.(*m3u8.MasterPlaylist)
+	if !ok {
+		return nil, fmt.Errorf("[%s] isn't a master playlist", manifestURL)
+	}
+	return masterpl, nil
+}
+
+func (e *Engine) downloadAndDecodeM3U8File(ctx context.Context, playlistURL string) (m3u8.Playlist, error) {
+	body, err := e.downloadM3U8File(ctx, playlistURL)
 	if err != nil {
-		return SteamAppDetails{}, err
+		return nil, err
 	}
+	return decodeM3U8File(playlistURL, body)
+}
 
-	defer resp.Body.Close()
-	var wrapper map[string]SteamAppDetailsData
+func (e *Engine) downloadM3U8File(ctx context.Context, playlistURL string) ([]byte, error) {
+	return responseCache.Get(ctx, e.httpClient, playlistURL, playlistCacheTTL, func(resp *http.Response) error {
+		return checkResponse(resp, "HLS playlist")
+	})
+}
 
-	err = json.NewDecoder(resp.Body).Decode(&wrapper)
+func decodeM3U8File(playlistURL string, body []byte) (m3u8.Playlist, error) {
+	paylist, _, err := m3u8.DecodeFrom(bytes.NewReader(normalizeMapByteRanges(body)), false)
 	if err != nil {
-		return SteamAppDetails{}, err
+		return nil, &DecodeError{URL: playlistURL, Err: err}
 	}
+	return paylist, nil
+}
 
-	data, ok := wrapper[steamAppID]
-	if !ok {
-		return SteamAppDetails{}, errors.New("can't find app details from steam API")
+func (e *Engine) getSteamAppDetails(ctx context.Context) (SteamAppDetails, error) {
+	opts := AppDetailsOptions{Language: storeLanguage}
+
+	countries := strings.Split(countryCodes, ",")
+	if len(countries) > 1 {
+		return e.steamClient.MergedAppDetails(ctx, e.steamAppId, opts, countries)
 	}
 
-	return data.Data, nil
+	opts.CountryCode = countries[0]
+	return e.steamClient.AppDetails(ctx, e.steamAppId, opts)
 }
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/Eyevinn/hls-m3u8/m3u8"
+)
+
+type ManifestKind string
+
+const (
+	HLSManifest  ManifestKind = "hls"
+	DASHManifest ManifestKind = "dash"
+)
+
+func parseManifestKind(value string) (ManifestKind, error) {
+	switch kind := ManifestKind(strings.ToLower(value)); kind {
+	case HLSManifest, DASHManifest:
+		return kind, nil
+	}
+	return "", fmt.Errorf("unknown manifest format [%s]", value)
+}
+
+// Media segment ready to be downloaded. The initialization section is also handled as a segment,
+// always being the first one of the list.
+type mediaSegment struct {
+	url string
+	// sub-range of the file addressed by EXT-X-BYTERANGE, the whole file when length is zero
+	offset int64
+	length int64
+	// nil when the segment isn't encrypted
+	key *segmentKey
+}
+
+// Name shown on progress and errors, without the query token.
+func (s mediaSegment) name() string {
+	name := s.url
+	if u, err := url.Parse(s.url); err == nil {
+		name = path.Base(u.Path)
+	}
+	if s.length > 0 {
+		name += fmt.Sprintf(" [%d-%d]", s.offset, s.offset+s.length-1)
+	}
+	return name
+}
+
+// Renditions of a trailer decoded from its manifest, no matter the format of it.
+type trailerManifest struct {
+	videoPlaylists     []*videoPlaylist
+	audioRenditions    []*rendition
+	subtitleRenditions []*rendition
+}
+
+// Audio or subtitles rendition of a trailer. Variants play the renditions of their AUDIO and
+// SUBTITLES groups.
+type rendition struct {
+	uri        string
+	groupID    string
+	name       string
+	language   string
+	isDefault  bool
+	autoselect bool
+	// carried by the variant stream itself, so it doesn't have segments of its own
+	muxed    bool
+	segments []mediaSegment
+}
+
+// Backends decode the manifest format they understand into the renditions used by the engine.
+type ManifestBackend interface {
+	Load(ctx context.Context, manifestURL string) (*trailerManifest, error)
+}
+
+// Manifest published for the trailer. The codec comes from the steam field the manifest was found.
+type manifestSource struct {
+	kind  ManifestKind
+	codec VideoCodec
+	url   string
+}
+
+// Manifests available for the trailer, the ones of the preferred kind coming first.
+func getManifestSources(trailer TrailerData, preferred ManifestKind) []manifestSource {
+	sources := make([]manifestSource, 0, 3)
+	for _, source := range []manifestSource{
+		{kind: HLSManifest, codec: H264Codec, url: trailer.HLSManifest},
+		{kind: DASHManifest, codec: H264Codec, url: trailer.DashH264},
+		{kind: DASHManifest, codec: AV1Codec, url: trailer.DashAV1},
+	} {
+		if source.url != "" {
+			sources = append(sources, source)
+		}
+	}
+
+	rank := func(s manifestSource) int {
+		if s.kind == preferred {
+			return 0
+		}
+		return 1
+	}
+	slices.SortStableFunc(sources, func(a, b manifestSource) int {
+		return cmp.Compare(rank(a), rank(b))
+	})
+	return sources
+}
+
+func (e *Engine) newManifestBackend(kind ManifestKind) ManifestBackend {
+	if kind == DASHManifest {
+		return &dashBackend{httpClient: e.httpClient}
+	}
+	return &hlsBackend{e: e}
+}
+
+// Load the video variants of the first codec of the preference found on the trailer manifests.
+// Manifests published for the codec are tried first, but any manifest may list variants of other
+// codecs, so the remaining ones are also checked before moving to the next codec.
+func (e *Engine) loadTrailerManifest(ctx context.Context, trailer TrailerData) error {
+	sources := getManifestSources(trailer, preferredManifest)
+	if len(sources) == 0 {
+		return errors.New("trailer doesn't have any HLS or DASH manifest")
+	}
+
+	loaded := make(map[string]*trailerManifest)
+	for _, codec := range codecPreference {
+		rank := func(s manifestSource) int {
+			if s.codec == codec {
+				return 0
+			}
+			return 1
+		}
+		ordered := slices.Clone(sources)
+		slices.SortStableFunc(ordered, func(a, b manifestSource) int {
+			return cmp.Compare(rank(a), rank(b))
+		})
+
+		for _, source := range ordered {
+			manifest, ok := loaded[source.url]
+			if !ok {
+				var err error
+				manifest, err = e.newManifestBackend(source.kind).Load(ctx, source.url)
+				if err != nil {
+					return fmt.Errorf("load %s manifest [%s]: %w", source.kind, source.url, err)
+				}
+				loaded[source.url] = manifest
+			}
+
+			playlists := filterPlaylistsByCodec(manifest.videoPlaylists, codec, source.codec)
+			if len(playlists) > 0 {
+				e.videoPlaylists = playlists
+				e.audioRenditions = manifest.audioRenditions
+				e.subtitleRenditions = manifest.subtitleRenditions
+				e.videoCodec = codec
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("trailer doesn't have any video variant encoded with %v", codecPreference)
+}
+
+/**
+ * HLS backend.
+ */
+
+type hlsBackend struct {
+	e *Engine
+}
+
+func (b *hlsBackend) Load(ctx context.Context, manifestURL string) (*trailerManifest, error) {
+	masterURL, err := url.Parse(manifestURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HLS manifest URL [%s]: %w", manifestURL, err)
+	}
+
+	masterpl, err := b.e.selectMasterPlaylist(ctx, manifestURL)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &trailerManifest{}
+
+	// setup video playlist variants by resolution
+	for _, variant := range masterpl.Variants {
+		// I-frame playlists only carry keyframes for trick play
+		if variant.Iframe {
+			continue
+		}
+
+		mediapl, err := b.loadMediaPlaylist(ctx, masterURL, variant.URI)
+		if err != nil {
+			return nil, fmt.Errorf("variant [%s]: %w", variant.URI, err)
+		}
+
+		segments, err := b.getSegments(mediapl)
+		if err != nil {
+			return nil, fmt.Errorf("variant [%s]: %w", variant.URI, err)
+		}
+
+		manifest.videoPlaylists = append(manifest.videoPlaylists, &videoPlaylist{
+			variant:  variant,
+			segments: segments,
+			duration: getPlaylistDuration(mediapl.MediaPlaylist),
+		})
+	}
+
+	// variants list the renditions of their groups in the order of the manifest, sharing them
+	seen := make(map[*m3u8.Alternative]bool)
+	for _, variant := range masterpl.Variants {
+		for _, alt := range variant.Alternatives {
+			if seen[alt] {
+				continue
+			}
+			seen[alt] = true
+
+			var renditions *[]*rendition
+			switch {
+			case alt.Type == "AUDIO":
+				renditions = &manifest.audioRenditions
+			case alt.Type == "SUBTITLES" && subtitleMode != NoSubtitles:
+				renditions = &manifest.subtitleRenditions
+			default:
+				continue
+			}
+
+			// audio renditions without URI are muxed on the variant stream itself
+			if alt.URI == "" {
+				if alt.Type == "AUDIO" {
+					r := newRendition(alt, nil)
+					r.muxed = true
+					*renditions = append(*renditions, r)
+				}
+				continue
+			}
+
+			r, err := b.loadRendition(ctx, masterURL, alt)
+			if err != nil {
+				return nil, fmt.Errorf("%s rendition [%s]: %w", strings.ToLower(alt.Type), alt.URI, err)
+			}
+			*renditions = append(*renditions, r)
+		}
+	}
+
+	return manifest, nil
+}
+
+func (b *hlsBackend) loadRendition(ctx context.Context, masterURL *url.URL, alt *m3u8.Alternative) (*rendition, error) {
+	mediapl, err := b.loadMediaPlaylist(ctx, masterURL, alt.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	segments, err := b.getSegments(mediapl)
+	if err != nil {
+		return nil, err
+	}
+
+	return newRendition(alt, segments), nil
+}
+
+func newRendition(alt *m3u8.Alternative, segments []mediaSegment) *rendition {
+	return &rendition{
+		uri:        alt.URI,
+		groupID:    alt.GroupId,
+		name:       alt.Name,
+		language:   alt.Language,
+		isDefault:  alt.Default,
+		autoselect: alt.Autoselect,
+		segments:   segments,
+	}
+}
+
+// Media playlist with the URL its own references are resolved against.
+type mediaPlaylist struct {
+	*m3u8.MediaPlaylist
+	url *url.URL
+	// segments whose EXT-X-MAP is written before their EXT-X-KEY tags
+	mapsBeforeKeys map[int]bool
+}
+
+// Media playlists are resolved against the master playlist URL.
+func (b *hlsBackend) loadMediaPlaylist(ctx context.Context, masterURL *url.URL, uri string) (*mediaPlaylist, error) {
+	playlistURL, err := resolveURL(masterURL, uri)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := b.e.downloadM3U8File(ctx, playlistURL.String())
+	if err != nil {
+		return nil, err
+	}
+	pl, err := decodeM3U8File(playlistURL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	mediapl, ok := pl.(*m3u8.MediaPlaylist)
+	if !ok {
+		return nil, fmt.Errorf("[%s] isn't a media playlist", playlistURL)
+	}
+	return &mediaPlaylist{MediaPlaylist: mediapl, url: playlistURL, mapsBeforeKeys: getMapsBeforeKeys(body)}, nil
+}
+
+// Keys apply from their EXT-X-KEY tag up to the next one, so the current key is carried along the
+// segments. An initialization section written after an AES-128 key is encrypted with it, using the
+// sequence number of the first segment it applies to when the key has no IV. The section is only
+// added again when a segment switches to a different one.
+func (b *hlsBackend) getSegments(m *mediaPlaylist) ([]mediaSegment, error) {
+	playlistURL := m.url
+	segments := make([]mediaSegment, 0, len(m.Segments)+1)
+
+	var lastMap *mediaSegment
+	appendMap := func(m *m3u8.Map, key *m3u8.Key, seqID uint64) error {
+		mapURL, err := resolveURL(playlistURL, m.URI)
+		if err != nil {
+			return err
+		}
+		mapKey, err := getSegmentKey(playlistURL, key, seqID)
+		if err != nil {
+			return fmt.Errorf("initialization section [%s]: %w", m.URI, err)
+		}
+
+		mapSegment := mediaSegment{url: mapURL.String(), offset: m.Offset, length: m.Limit, key: mapKey}
+		if lastMap == nil || lastMap.url != mapSegment.url ||
+			lastMap.offset != mapSegment.offset || lastMap.length != mapSegment.length {
+			segments = append(segments, mapSegment)
+			lastMap = &mapSegment
+		}
+		return nil
+	}
+
+	// the parser keeps the map before the first segment on the playlist
+	pendingMap := m.Map
+	var key *m3u8.Key
+	var previous mediaSegment
+	for i, seg := range m.Segments {
+		if seg == nil {
+			continue
+		}
+
+		mapKey := key
+		if len(seg.Keys) > 0 {
+			key = selectKey(seg.Keys)
+		}
+		if !m.mapsBeforeKeys[i] {
+			mapKey = key
+		}
+		if seg.Map != nil {
+			pendingMap = seg.Map
+		}
+		if pendingMap != nil {
+			if err := appendMap(pendingMap, mapKey, seg.SeqId); err != nil {
+				return nil, err
+			}
+			pendingMap = nil
+		}
+
+		segmentURL, err := resolveURL(playlistURL, seg.URI)
+		if err != nil {
+			return nil, err
+		}
+		segmentKey, err := getSegmentKey(playlistURL, key, seg.SeqId)
+		if err != nil {
+			return nil, fmt.Errorf("segment [%s]: %w", seg.URI, err)
+		}
+
+		segment := mediaSegment{url: segmentURL.String(), offset: seg.Offset, length: seg.Limit, key: segmentKey}
+		// a sub-range without offset starts where the previous one of the same file ended, which the
+		// decoder reads as a zero offset
+		if segment.length > 0 && segment.offset == 0 && previous.length > 0 && previous.url == segment.url {
+			segment.offset = previous.offset + previous.length
+		}
+		segments = append(segments, segment)
+		previous = segment
+	}
+	return segments, nil
+}
+
+// BYTERANGE of EXT-X-MAP is a quoted "<length>[@<offset>]", but the m3u8 decoder only reads it
+// unquoted and with the offset, silently dropping the whole tag otherwise.
+var mapByteRangePattern = regexp.MustCompile(`(?m)^(#EXT-X-MAP:.*BYTERANGE=)"(\d+)(?:@(\d+))?"`)
+
+func normalizeMapByteRanges(playlist []byte) []byte {
+	return mapByteRangePattern.ReplaceAllFunc(playlist, func(match []byte) []byte {
+		parts := mapByteRangePattern.FindSubmatch(match)
+		offset := parts[3]
+		if len(offset) == 0 {
+			offset = []byte("0")
+		}
+		return fmt.Appendf(nil, "%s%s@%s", parts[1], parts[2], offset)
+	})
+}
+
+// The parser attaches the EXT-X-MAP and EXT-X-KEY tags written before a segment to it, losing their
+// order, while the map is only encrypted by the keys written before it. Report the segments, by
+// index, whose EXT-X-MAP comes before their EXT-X-KEY tags.
+func getMapsBeforeKeys(playlist []byte) map[int]bool {
+	result := make(map[int]bool)
+
+	var segment int
+	var mapWritten bool
+	for _, line := range strings.Split(string(playlist), "\n") {
+		switch line = strings.TrimSpace(line); {
+		case line == "":
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			mapWritten = true
+		case strings.HasPrefix(line, "#EXT-X-KEY:"):
+			if mapWritten {
+				result[segment] = true
+			}
+		case strings.HasPrefix(line, "#"):
+		default:
+			segment++
+			mapWritten = false
+		}
+	}
+	return result
+}
+
+// Playlists may offer the same key in several formats, the plain one is preferred.
+func selectKey(keys []m3u8.Key) *m3u8.Key {
+	for i := range keys {
+		if keys[i].Keyformat == "" || keys[i].Keyformat == identityKeyFormat {
+			return &keys[i]
+		}
+	}
+	return &keys[0]
+}
+
+// Resolve the reference against the URL of the document it was found on (RFC 3986). CDNs sign
+// the manifest URL with a query token and ask for it on every child request, so references without
+// a query of their own keep the query of the base when they're served by the same host.
+func resolveURL(base *url.URL, ref string) (*url.URL, error) {
+	refURL, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL reference [%s]: %w", ref, err)
+	}
+
+	resolved := base.ResolveReference(refURL)
+	if refURL.RawQuery == "" && !refURL.ForceQuery && resolved.Host == base.Host {
+		resolved.RawQuery = base.RawQuery
+	}
+	return resolved, nil
+}
+
+func getPlaylistDuration(pl *m3u8.MediaPlaylist) float64 {
+	var duration float64
+	for _, seg := range pl.Segments {
+		if seg != nil {
+			duration += seg.Duration
+		}
+	}
+	return duration
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"path"
+	"slices"
+	"testing"
+
+	"github.com/Eyevinn/hls-m3u8/m3u8"
+)
+
+func decodeTestMediaPlaylist(t *testing.T, playlist string) *mediaPlaylist {
+	t.Helper()
+
+	playlistURL, _ := url.Parse("http://cdn.test/hls/video.m3u8")
+	pl, err := decodeM3U8File(playlistURL.String(), []byte(playlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediapl, ok := pl.(*m3u8.MediaPlaylist)
+	if !ok {
+		t.Fatalf("decoded %T, want a media playlist", pl)
+	}
+	return &mediaPlaylist{MediaPlaylist: mediapl, url: playlistURL, mapsBeforeKeys: getMapsBeforeKeys([]byte(playlist))}
+}
+
+// Segments described by their name, key file and IV without its leading zeros.
+func getSegmentDescriptions(segments []mediaSegment) []string {
+	descriptions := make([]string, len(segments))
+	for i, seg := range segments {
+		descriptions[i] = seg.name()
+		if seg.key != nil {
+			descriptions[i] += fmt.Sprintf(" key=%s iv=%x", path.Base(seg.key.url), bytes.TrimLeft(seg.key.iv, "\x00"))
+		}
+	}
+	return descriptions
+}
+
+func TestGetSegmentsKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		playlist string
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name: "map after key is encrypted",
+			playlist: `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:10
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin"
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:4,
+seg10.m4s
+#EXTINF:4,
+seg11.m4s
+#EXT-X-ENDLIST
+`,
+			want: []string{"init.mp4 key=key.bin iv=0a", "seg10.m4s key=key.bin iv=0a", "seg11.m4s key=key.bin iv=0b"},
+		},
+		{
+			name: "map before key is clear",
+			playlist: `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:4
+#EXT-X-MAP:URI="init.mp4"
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin"
+#EXTINF:4,
+seg0.m4s
+#EXT-X-ENDLIST
+`,
+			want: []string{"init.mp4", "seg0.m4s key=key.bin iv="},
+		},
+		{
+			name: "explicit IV",
+			playlist: `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:10
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x0000000000000000000000000000002A
+#EXTINF:4,
+seg10.m4s
+#EXTINF:4,
+seg11.m4s
+#EXT-X-ENDLIST
+`,
+			want: []string{"seg10.m4s key=key.bin iv=2a", "seg11.m4s key=key.bin iv=2a"},
+		},
+		{
+			name: "key rotation",
+			playlist: `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:4
+#EXT-X-KEY:METHOD=AES-128,URI="key1.bin"
+#EXTINF:4,
+seg0.m4s
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:4,
+seg1.m4s
+#EXT-X-KEY:METHOD=AES-128,URI="key2.bin"
+#EXTINF:4,
+seg2.m4s
+#EXT-X-ENDLIST
+`,
+			want: []string{"seg0.m4s key=key1.bin iv=", "seg1.m4s", "seg2.m4s key=key2.bin iv=02"},
+		},
+		{
+			name: "map switched before the next key",
+			playlist: `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:4
+#EXT-X-KEY:METHOD=AES-128,URI="key1.bin"
+#EXT-X-MAP:URI="a.mp4"
+#EXTINF:4,
+seg0.m4s
+#EXT-X-MAP:URI="b.mp4"
+#EXT-X-KEY:METHOD=AES-128,URI="key2.bin"
+#EXTINF:4,
+seg1.m4s
+#EXT-X-ENDLIST
+`,
+			want: []string{"a.mp4 key=key1.bin iv=", "seg0.m4s key=key1.bin iv=", "b.mp4 key=key1.bin iv=01", "seg1.m4s key=key2.bin iv=01"},
+		},
+		{
+			name: "sample AES",
+			playlist: `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:4
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="key.bin"
+#EXTINF:4,
+seg0.ts
+#EXT-X-ENDLIST
+`,
+			wantErr: true,
+		},
+		{
+			name: "key without URI",
+			playlist: `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:4
+#EXT-X-KEY:METHOD=AES-128
+#EXTINF:4,
+seg0.ts
+#EXT-X-ENDLIST
+`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segments, err := (&hlsBackend{}).getSegments(decodeTestMediaPlaylist(t, tt.playlist))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got segments %v", getSegmentDescriptions(segments))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := getSegmentDescriptions(segments); !slices.Equal(got, tt.want) {
+				t.Errorf("segments = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetMapsBeforeKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		playlist string
+		want     []int
+	}{
+		{
+			name:     "key before map",
+			playlist: "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"k\"\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:4,\nseg0.m4s\n",
+			want:     []int{},
+		},
+		{
+			name:     "map before key",
+			playlist: "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXT-X-KEY:METHOD=AES-128,URI=\"k\"\n#EXTINF:4,\nseg0.m4s\n",
+			want:     []int{0},
+		},
+		{
+			name:     "map of a later segment",
+			playlist: "#EXTM3U\n#EXT-X-MAP:URI=\"a.mp4\"\n#EXTINF:4,\nseg0.m4s\n#EXTINF:4,\nseg1.m4s\n#EXT-X-MAP:URI=\"b.mp4\"\n#EXT-X-KEY:METHOD=AES-128,URI=\"k\"\n#EXTINF:4,\nseg2.m4s\n",
+			want:     []int{2},
+		},
+		{
+			name:     "map and key of different segments",
+			playlist: "#EXTM3U\n#EXT-X-MAP:URI=\"a.mp4\"\n#EXTINF:4,\nseg0.m4s\n#EXT-X-KEY:METHOD=AES-128,URI=\"k\"\n#EXTINF:4,\nseg1.m4s\n",
+			want:     []int{},
+		},
+		{
+			name:     "CRLF and blank lines",
+			playlist: "#EXTM3U\r\n\r\n#EXT-X-MAP:URI=\"init.mp4\"\r\n\r\n#EXT-X-KEY:METHOD=AES-128,URI=\"k\"\r\n#EXTINF:4,\r\nseg0.m4s\r\n",
+			want:     []int{0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := getMapsBeforeKeys([]byte(tt.playlist))
+			indexes := make([]int, 0, len(got))
+			for i := range got {
+				indexes = append(indexes, i)
+			}
+			slices.Sort(indexes)
+			if !slices.Equal(indexes, tt.want) {
+				t.Errorf("getMapsBeforeKeys() = %v, want %v", indexes, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetSegmentsByteRanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		playlist string
+		want     []string
+	}{
+		{
+			name: "implicit offsets",
+			playlist: `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:4
+#EXT-X-MAP:URI="main.mp4",BYTERANGE="720@0"
+#EXTINF:4,
+#EXT-X-BYTERANGE:1000@720
+main.mp4
+#EXTINF:4,
+#EXT-X-BYTERANGE:1200
+main.mp4
+#EXTINF:4,
+#EXT-X-BYTERANGE:800
+main.mp4
+#EXT-X-ENDLIST
+`,
+			want: []string{"main.mp4 [0-719]", "main.mp4 [720-1719]", "main.mp4 [1720-2919]", "main.mp4 [2920-3719]"},
+		},
+		{
+			name: "implicit offset on another file",
+			playlist: `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:4
+#EXTINF:4,
+#EXT-X-BYTERANGE:1000@500
+a.ts
+#EXTINF:4,
+#EXT-X-BYTERANGE:1000
+b.ts
+#EXT-X-ENDLIST
+`,
+			want: []string{"a.ts [500-1499]", "b.ts [0-999]"},
+		},
+		{
+			name: "map without offset",
+			playlist: `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:4
+#EXT-X-MAP:URI="main.mp4",BYTERANGE="720"
+#EXTINF:4,
+#EXT-X-BYTERANGE:1000@720
+main.mp4
+#EXT-X-ENDLIST
+`,
+			want: []string{"main.mp4 [0-719]", "main.mp4 [720-1719]"},
+		},
+		{
+			name: "repeated map",
+			playlist: `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:4
+#EXT-X-MAP:URI="main.mp4",BYTERANGE="720@0"
+#EXTINF:4,
+#EXT-X-BYTERANGE:1000@720
+main.mp4
+#EXT-X-MAP:URI="main.mp4",BYTERANGE="720@0"
+#EXTINF:4,
+#EXT-X-BYTERANGE:1000@1720
+main.mp4
+#EXT-X-MAP:URI="main.mp4",BYTERANGE="600@2720"
+#EXTINF:4,
+#EXT-X-BYTERANGE:1000@3320
+main.mp4
+#EXT-X-ENDLIST
+`,
+			want: []string{"main.mp4 [0-719]", "main.mp4 [720-1719]", "main.mp4 [1720-2719]", "main.mp4 [2720-3319]", "main.mp4 [3320-4319]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segments, err := (&hlsBackend{}).getSegments(decodeTestMediaPlaylist(t, tt.playlist))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := getSegmentDescriptions(segments); !slices.Equal(got, tt.want) {
+				t.Errorf("segments = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeMapByteRanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		playlist string
+		want     string
+	}{
+		{
+			name:     "quoted with offset",
+			playlist: "#EXT-X-MAP:URI=\"main.mp4\",BYTERANGE=\"720@100\"\n",
+			want:     "#EXT-X-MAP:URI=\"main.mp4\",BYTERANGE=720@100\n",
+		},
+		{
+			name:     "quoted without offset",
+			playlist: "#EXT-X-MAP:URI=\"main.mp4\",BYTERANGE=\"720\"\n",
+			want:     "#EXT-X-MAP:URI=\"main.mp4\",BYTERANGE=720@0\n",
+		},
+		{
+			name:     "already unquoted",
+			playlist: "#EXT-X-MAP:URI=\"main.mp4\",BYTERANGE=720@100\n",
+			want:     "#EXT-X-MAP:URI=\"main.mp4\",BYTERANGE=720@100\n",
+		},
+		{
+			name:     "segment byte ranges",
+			playlist: "#EXT-X-BYTERANGE:1000\nmain.mp4\n",
+			want:     "#EXT-X-BYTERANGE:1000\nmain.mp4\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(normalizeMapByteRanges([]byte(tt.playlist))); got != tt.want {
+				t.Errorf("normalizeMapByteRanges() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -12,6 +12,9 @@ import (
 	"golang.org/x/term"
 )
 
+// Width used to size the line blocks when there's no terminal to query.
+const headlessWindowWidth = 80
+
 type windowTable struct {
 	sync.Mutex
 	initialCursorPos int
@@ -20,8 +23,20 @@ type windowTable struct {
 	endOfTablePos    int
 	lines            []*windowLine
 	oldTermState     *term.State
+	// when stdout isn't a terminal (cron jobs, CI, containers without TTY) nothing is rendered.
+	headless bool
+	// closed once the refresh routine renders the last update
+	refreshDone chan struct{}
 }
 
+// Window table shared by every download running at the same time.
+var (
+	sharedWindowMu    sync.Mutex
+	sharedWindow      *windowTable
+	sharedWindowUsers int
+	stopSharedRefresh context.CancelFunc
+)
+
 type LineBlock interface {
 	// Retrieve the current content of the block likelly updated. Should be used trougth a mutex.
 	Content() string
@@ -41,7 +56,9 @@ func (w *windowTable) addLine(blks ...LineBlock) (*windowLine, error) {
 	w.Lock()
 	defer w.Unlock()
 
-	fmt.Println("")
+	if !w.headless {
+		fmt.Println("")
+	}
 	line := &windowLine{
 		blocks: make([]*lineBlockInfo, len(blks)),
 	}
@@ -76,7 +93,7 @@ type windowLine struct {
 func (w *windowTable) updateLines() {
 	w.Lock()
 	defer w.Unlock()
-	if len(w.lines) < 1 {
+	if len(w.lines) < 1 || w.headless {
 		return
 	}
 
@@ -92,10 +109,22 @@ func (w *windowTable) updateLines() {
 }
 
 func (wt *windowTable) Close() {
+	if wt.headless {
+		return
+	}
 	term.Restore(1, wt.oldTermState)
 }
 
+// The table is headless when stdout isn't a terminal, or when stdin can't answer the cursor
+// position query because it was read as the input file.
 func SetupWindowTable() (*windowTable, error) {
+	if !term.IsTerminal(1) || stdinInput {
+		return &windowTable{
+			maxWindowWidth: headlessWindowWidth,
+			headless:       true,
+		}, nil
+	}
+
 	winMaxWidth, _, err := term.GetSize(1)
 	if err != nil {
 		return nil, err
@@ -108,6 +137,7 @@ func SetupWindowTable() (*windowTable, error) {
 
 	posRow, _, err := getCursorPos()
 	if err != nil {
+		term.Restore(1, state)
 		return nil, err
 	}
 
@@ -121,7 +151,9 @@ func SetupWindowTable() (*windowTable, error) {
 }
 
 func (wt *windowTable) RefreshRoutine(ctx context.Context) {
+	wt.refreshDone = make(chan struct{})
 	go func() {
+		defer close(wt.refreshDone)
 		for {
 			select {
 			case <-ctx.Done():
@@ -135,6 +167,46 @@ func (wt *windowTable) RefreshRoutine(ctx context.Context) {
 	}()
 }
 
+// Acquire the window table shared between concurrent downloads, setting it up on the first call.
+// Every call must be paired with ReleaseWindowTable.
+func AcquireWindowTable() (*windowTable, error) {
+	sharedWindowMu.Lock()
+	defer sharedWindowMu.Unlock()
+
+	if sharedWindow == nil {
+		w, err := SetupWindowTable()
+		if err != nil {
+			return nil, err
+		}
+
+		// the table outlives any single download, so it's not bound to their contexts
+		ctx, cancel := context.WithCancel(context.Background())
+		w.RefreshRoutine(ctx)
+
+		sharedWindow = w
+		stopSharedRefresh = cancel
+	}
+
+	sharedWindowUsers++
+	return sharedWindow, nil
+}
+
+// Release the shared window table. The last user stops the refresh routine and restores the terminal.
+func ReleaseWindowTable() {
+	sharedWindowMu.Lock()
+	defer sharedWindowMu.Unlock()
+
+	sharedWindowUsers--
+	if sharedWindowUsers > 0 || sharedWindow == nil {
+		return
+	}
+
+	stopSharedRefresh()
+	<-sharedWindow.refreshDone
+	sharedWindow.Close()
+	sharedWindow = nil
+}
+
 /**
  * Progress Bar Block
  */
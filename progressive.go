@@ -0,0 +1,376 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Max number of times a progressive download is resumed after the connection drops.
+	maxResumeAttempts = 3
+	// Progressive files are downloaded without a request timeout, only failing when the connection
+	// doesn't deliver anything for this long.
+	progressiveIdleTimeout = 30 * time.Second
+)
+
+var errStalledDownload = fmt.Errorf("connection stalled for %s", progressiveIdleTimeout)
+
+// Progressive file of a trailer, with video and audio on the same file. Older apps only publish
+// these, keyed by quality on the "mp4" and "webm" fields of the movie.
+type progressiveSource struct {
+	container string
+	quality   string
+	url       string
+}
+
+func (s progressiveSource) String() string {
+	return fmt.Sprintf("%s (%s)", s.quality, s.container)
+}
+
+// Steam uses the height as quality, or "max" for the highest one.
+func getProgressiveQualityRank(quality string) int {
+	if quality == "max" {
+		return math.MaxInt
+	}
+	rank, _ := getProgressiveHeight(quality)
+	return rank
+}
+
+// Height of the file, unknown for the "max" quality.
+func getProgressiveHeight(quality string) (int, bool) {
+	height, err := strconv.Atoi(strings.TrimSuffix(quality, "p"))
+	return height, err == nil && height > 0
+}
+
+// Progressive files of the trailer, the ones already on the output container coming first, then
+// from the lowest to the highest quality.
+func getProgressiveSources(trailer TrailerData) []progressiveSource {
+	sources := make([]progressiveSource, 0, len(trailer.MP4)+len(trailer.WebM))
+	for quality, fileURL := range trailer.MP4 {
+		sources = append(sources, progressiveSource{container: "mp4", quality: quality, url: fileURL})
+	}
+	for quality, fileURL := range trailer.WebM {
+		sources = append(sources, progressiveSource{container: "webm", quality: quality, url: fileURL})
+	}
+
+	rank := func(s progressiveSource) int {
+		if s.container == outputContainer {
+			return 0
+		}
+		return 1
+	}
+	slices.SortFunc(sources, func(a, b progressiveSource) int {
+		return cmp.Or(
+			cmp.Compare(rank(a), rank(b)),
+			cmp.Compare(a.container, b.container),
+			cmp.Compare(getProgressiveQualityRank(a.quality), getProgressiveQualityRank(b.quality)),
+		)
+	})
+	return sources
+}
+
+// Progressive files only carry the height steam labels them with, so the quality policy can only
+// limit the height before picking the best or the worst file. Files of unknown height ("max") never
+// match a height limit.
+func chooseProgressiveSource(ctx context.Context, sources []progressiveSource, policy *qualityPolicy) (progressiveSource, error) {
+	if policy != nil {
+		if filters := getProgressiveUnsupportedFilters(policy); len(filters) > 0 {
+			return progressiveSource{}, fmt.Errorf("quality policy filters by %s, which progressive files don't carry", strings.Join(filters, ", "))
+		}
+
+		candidates := slices.DeleteFunc(slices.Clone(sources), func(s progressiveSource) bool {
+			if policy.maxHeight == 0 {
+				return false
+			}
+			height, ok := getProgressiveHeight(s.quality)
+			return !ok || height > policy.maxHeight
+		})
+		if len(candidates) == 0 {
+			return progressiveSource{}, errors.New("no progressive file matches the quality policy")
+		}
+
+		// sources on the output container come first
+		container := candidates[0].container
+		candidates = slices.DeleteFunc(candidates, func(s progressiveSource) bool {
+			return s.container != container
+		})
+		if policy.worst {
+			return candidates[0], nil
+		}
+		return candidates[len(candidates)-1], nil
+	}
+
+	fmt.Println("Select progressive file option:")
+	for i, source := range sources {
+		fmt.Printf(" [%d] %s\n", i+1, source)
+	}
+
+	selectedIdx, err := getInputNumber(ctx, 1, len(sources))
+	if err != nil {
+		return progressiveSource{}, err
+	}
+	return sources[selectedIdx-1], nil
+}
+
+func getProgressiveUnsupportedFilters(policy *qualityPolicy) []string {
+	filters := make([]string, 0)
+	if policy.resolution != "" {
+		filters = append(filters, "resolution")
+	}
+	if policy.maxBandwidth > 0 {
+		filters = append(filters, "bandwidth")
+	}
+	if policy.codec != "" {
+		filters = append(filters, "codec")
+	}
+	if policy.maxFrameRate > 0 || policy.frameRate > 0 {
+		filters = append(filters, "frame rate")
+	}
+	return filters
+}
+
+// Partial files are keyed by the source URL, so a run picking another file (another quality, or the
+// same one from a new URL) never appends its bytes to the ones of a different file.
+func getPartialPath(outputPath string, source progressiveSource) string {
+	sum := sha256.Sum256([]byte(source.url))
+	base := strings.TrimSuffix(outputPath, path.Ext(outputPath))
+	return fmt.Sprintf("%s.%s.%s.part", base, hex.EncodeToString(sum[:4]), source.container)
+}
+
+// The file is downloaded next to the output as a partial file, kept on failures so the next run
+// resumes it. It's remuxed only when its container isn't the output one.
+func (e *Engine) downloadProgressiveTrailer(ctx context.Context, trailer TrailerData, outputName string, metadata map[string]string) error {
+	sources := getProgressiveSources(trailer)
+	if len(sources) == 0 {
+		return errors.New("trailer doesn't have any manifest or progressive file")
+	}
+
+	source, err := chooseProgressiveSource(ctx, sources, videoQuality)
+	if err != nil {
+		return err
+	}
+
+	outputPath, err := validateOutputPath(outputDir, outputName)
+	if err != nil {
+		return fmt.Errorf("output path validation: %w", err)
+	}
+	partialPath := getPartialPath(outputPath, source)
+
+	w, err := AcquireWindowTable()
+	if err != nil {
+		return fmt.Errorf("setup window table: %w", err)
+	}
+	defer ReleaseWindowTable()
+
+	progress := NewProgressLine()
+	if _, err := w.addLine(progress.Blocks()...); err != nil {
+		return err
+	}
+	progress.UpdateInfo(fmt.Sprintf("Downloading %s", path.Base(partialPath)))
+
+	// shared between attempts, so resuming doesn't report the same bytes again
+	pw := &progressWriter{progress: progress}
+	for attempt := 0; ; attempt++ {
+		err = e.downloadResumable(ctx, source.url, partialPath, pw)
+		if err == nil {
+			break
+		}
+
+		var statusErr *HTTPStatusError
+		if attempt == maxResumeAttempts || ctx.Err() != nil || errors.As(err, &statusErr) {
+			return fmt.Errorf("download progressive file [%s]: %w", source.url, err)
+		}
+
+		progress.UpdateInfo(fmt.Sprintf("Resuming %s (%d/%d)", path.Base(partialPath), attempt+1, maxResumeAttempts))
+		if err := sleepContext(ctx, getRetryBackoff(attempt)); err != nil {
+			return err
+		}
+	}
+
+	os.Remove(getValidatorPath(partialPath))
+
+	if source.container == outputContainer {
+		return os.Rename(partialPath, outputPath)
+	}
+
+	if err := TransformMedia(outputPath, metadata, MediaInput{File: partialPath}); err != nil {
+		return fmt.Errorf("transforming to output format: %w", err)
+	}
+	return os.Remove(partialPath)
+}
+
+// Download the file appending to what is already written on it, asking only for the missing bytes
+// with a Range request. The request carries the validator of the partial file on If-Range, so
+// servers answer with the whole file when it changed since, which replaces the partial file, the
+// same as servers ignoring the range.
+func (e *Engine) downloadResumable(ctx context.Context, fileURL, filePath string, pw *progressWriter) error {
+	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	// the request is canceled once the connection stalls, the timer being pushed back on every read
+	reqCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	idle := time.AfterFunc(progressiveIdleTimeout, func() { cancel(errStalledDownload) })
+	defer idle.Stop()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if validator, err := os.ReadFile(getValidatorPath(filePath)); err == nil && len(validator) > 0 {
+			req.Header.Set("If-Range", string(validator))
+		}
+	}
+
+	resp, err := e.fileClient.Do(req)
+	if err != nil {
+		return getStalledError(reqCtx, err)
+	}
+	defer resp.Body.Close()
+
+	var total int64
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// a range not starting at the end of the partial file can't be appended to it
+		if start, ok := getContentRangeStart(resp.Header.Get("Content-Range")); !ok || start != offset {
+			if offset == 0 {
+				return fmt.Errorf("unexpected range [%s] of [%s]", resp.Header.Get("Content-Range"), fileURL)
+			}
+			resp.Body.Close()
+			idle.Stop()
+			if err := f.Truncate(0); err != nil {
+				return err
+			}
+			return e.downloadResumable(ctx, fileURL, filePath, pw)
+		}
+		total = offset + resp.ContentLength
+	case http.StatusOK:
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		offset, total = 0, resp.ContentLength
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the range starts at the end of the file, so it's already complete
+		if resp.Header.Get("Content-Range") == fmt.Sprintf("bytes */%d", offset) {
+			pw.total, pw.written = offset, offset
+			pw.advance(0)
+			return nil
+		}
+		return &HTTPStatusError{URL: fileURL, StatusCode: resp.StatusCode}
+	default:
+		return checkResponseStatus(resp)
+	}
+
+	if err := os.WriteFile(getValidatorPath(filePath), []byte(getRangeValidator(resp)), 0o644); err != nil {
+		return err
+	}
+
+	pw.w, pw.total, pw.written = f, total, offset
+	pw.advance(0)
+
+	written, err := io.Copy(pw, &idleTimeoutReader{r: resp.Body, timer: idle})
+	if err != nil {
+		return getStalledError(reqCtx, err)
+	}
+	if resp.ContentLength >= 0 && written != resp.ContentLength {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// Requests canceled by the idle timer fail with a context error, replaced by the stall itself.
+func getStalledError(reqCtx context.Context, err error) error {
+	if cause := context.Cause(reqCtx); errors.Is(cause, errStalledDownload) {
+		return cause
+	}
+	return err
+}
+
+// Reader pushing the idle timer of its request back on every read.
+type idleTimeoutReader struct {
+	r     io.Reader
+	timer *time.Timer
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.timer.Reset(progressiveIdleTimeout)
+	return n, err
+}
+
+// The validator of the partial file is kept next to it, until the download completes.
+func getValidatorPath(filePath string) string {
+	return filePath + ".validator"
+}
+
+// Weak ETags can't be used on If-Range, the modification date is used instead.
+func getRangeValidator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// Content-Range of a partial response has the format "bytes <start>-<end>/<size>".
+func getContentRangeStart(contentRange string) (int64, bool) {
+	spec, ok := strings.CutPrefix(contentRange, "bytes ")
+	if !ok {
+		return 0, false
+	}
+	start, _, found := strings.Cut(spec, "-")
+	n, err := strconv.ParseInt(start, 10, 64)
+	return n, found && err == nil
+}
+
+// Report the bytes written through it on the progress line, as a percentage of the total.
+type progressWriter struct {
+	w        io.Writer
+	progress *ProgressLine
+	total    int64
+	written  int64
+	reported int
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.advance(int64(n))
+	return n, err
+}
+
+func (pw *progressWriter) advance(n int64) {
+	pw.written += n
+	if pw.total <= 0 {
+		return
+	}
+
+	if percentage := int(pw.written * 100 / pw.total); percentage > pw.reported {
+		pw.progress.Progress(percentage - pw.reported)
+		pw.reported = percentage
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Eyevinn/hls-m3u8/m3u8"
+)
+
+// Policy used to pick a video variant without prompting the user.
+//
+// It's built from a comma separated list of terms:
+//
+//	best | worst     pick the highest/lowest variant left after filtering (default: best)
+//	1280x720         exact resolution
+//	<=1080p          max height
+//	<=2500k | <=5m   max bandwidth, in bits per second
+//	codec=avc1       one of the variant codecs must start with the given value
+//	fps<=30 | fps=60 frame rate filters
+type qualityPolicy struct {
+	worst        bool
+	resolution   string
+	maxHeight    int
+	maxBandwidth uint32
+	codec        string
+	maxFrameRate float64
+	frameRate    float64
+}
+
+func parseQualityPolicy(policy string) (*qualityPolicy, error) {
+	q := &qualityPolicy{}
+	for _, term := range strings.Split(policy, ",") {
+		term = strings.ToLower(strings.TrimSpace(term))
+
+		switch {
+		case term == "":
+			continue
+		case term == "best":
+			q.worst = false
+		case term == "worst":
+			q.worst = true
+		case strings.HasPrefix(term, "codec="):
+			q.codec = strings.TrimPrefix(term, "codec=")
+		case strings.HasPrefix(term, "fps<="):
+			fps, err := strconv.ParseFloat(strings.TrimPrefix(term, "fps<="), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid frame rate on quality term [%s]", term)
+			}
+			q.maxFrameRate = fps
+		case strings.HasPrefix(term, "fps="):
+			fps, err := strconv.ParseFloat(strings.TrimPrefix(term, "fps="), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid frame rate on quality term [%s]", term)
+			}
+			q.frameRate = fps
+		case strings.HasPrefix(term, "<="):
+			if err := q.parseUpperBound(strings.TrimPrefix(term, "<=")); err != nil {
+				return nil, fmt.Errorf("invalid quality term [%s]: %w", term, err)
+			}
+		default:
+			if _, _, ok := parseResolution(term); !ok {
+				return nil, fmt.Errorf("unknown quality term [%s]", term)
+			}
+			q.resolution = term
+		}
+	}
+	return q, nil
+}
+
+// The upper bound is a height when suffixed by "p", otherwise it's a bandwidth.
+func (q *qualityPolicy) parseUpperBound(value string) error {
+	if height, ok := strings.CutSuffix(value, "p"); ok {
+		h, err := strconv.Atoi(height)
+		if err != nil {
+			return err
+		}
+		q.maxHeight = h
+		return nil
+	}
+
+	multiplier := uint64(1)
+	if v, ok := strings.CutSuffix(value, "k"); ok {
+		value, multiplier = v, 1_000
+	} else if v, ok := strings.CutSuffix(value, "m"); ok {
+		value, multiplier = v, 1_000_000
+	}
+
+	bw, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return err
+	}
+	if bw*multiplier > uint64(^uint32(0)) {
+		return errors.New("bandwidth too large")
+	}
+	q.maxBandwidth = uint32(bw * multiplier)
+	return nil
+}
+
+func (q *qualityPolicy) match(v *m3u8.Variant) bool {
+	if q.resolution != "" && v.Resolution != q.resolution {
+		return false
+	}
+	if _, height, _ := parseResolution(v.Resolution); q.maxHeight > 0 && height > q.maxHeight {
+		return false
+	}
+	if q.maxBandwidth > 0 && v.Bandwidth > q.maxBandwidth {
+		return false
+	}
+	if q.maxFrameRate > 0 && v.FrameRate > q.maxFrameRate {
+		return false
+	}
+	if q.frameRate > 0 && v.FrameRate != q.frameRate {
+		return false
+	}
+	if q.codec != "" && !slices.ContainsFunc(strings.Split(v.Codecs, ","), func(c string) bool {
+		return strings.HasPrefix(strings.ToLower(strings.TrimSpace(c)), q.codec)
+	}) {
+		return false
+	}
+	return true
+}
+
+// Playlists must be sorted with sortVideoPlaylists, so the picked variant is always the same
+// for the same master playlist.
+func (q *qualityPolicy) selectVariant(playlists []*videoPlaylist) (*videoPlaylist, error) {
+	candidates := make([]*videoPlaylist, 0, len(playlists))
+	for _, pl := range playlists {
+		if q.match(pl.variant) {
+			candidates = append(candidates, pl)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, errors.New("no video variant matches the quality policy")
+	}
+
+	if q.worst {
+		return candidates[0], nil
+	}
+	return candidates[len(candidates)-1], nil
+}
+
+// Sort playlists from the lowest to the highest quality, using resolution, bandwidth and
+// frame rate as sort keys.
+func sortVideoPlaylists(playlists []*videoPlaylist) {
+	slices.SortStableFunc(playlists, func(a, b *videoPlaylist) int {
+		aWidth, aHeight, _ := parseResolution(a.variant.Resolution)
+		bWidth, bHeight, _ := parseResolution(b.variant.Resolution)
+
+		return cmp.Or(
+			cmp.Compare(aHeight, bHeight),
+			cmp.Compare(aWidth, bWidth),
+			cmp.Compare(a.variant.Bandwidth, b.variant.Bandwidth),
+			cmp.Compare(a.variant.FrameRate, b.variant.FrameRate),
+			cmp.Compare(a.variant.URI, b.variant.URI),
+		)
+	})
+}
+
+// Parse a resolution with the format WxH, like 1280x720.
+func parseResolution(res string) (width int, height int, ok bool) {
+	w, h, found := strings.Cut(res, "x")
+	if !found {
+		return 0, 0, false
+	}
+
+	width, wErr := strconv.Atoi(w)
+	height, hErr := strconv.Atoi(h)
+	if wErr != nil || hErr != nil {
+		return 0, 0, false
+	}
+	return width, height, true
+}
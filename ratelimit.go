@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// the store answers 429 to clients going above ~200 requests every 5 minutes
+	defaultSteamRateLimit = 1.0
+	steamRateLimitBurst   = 10
+	// times a request answered with 429 or 503 is sent again
+	maxRateLimitRetries = 3
+	// wait used when the server doesn't say how long to wait
+	defaultRetryAfter = 5 * time.Second
+	// longer waits are returned to the caller, the request would reach the client timeout anyway
+	maxRetryAfter = 30 * time.Second
+)
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Take a token, blocking until one is available.
+func (b *tokenBucket) Wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+
+		if err := sleepContext(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Token bucket of each limited host, hosts without one aren't limited. Buckets are shared by every
+// HTTP client, so apps running at the same time share the same limits.
+type hostRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+var rateLimiter = &hostRateLimiter{buckets: make(map[string]*tokenBucket)}
+
+// A rate of zero or less removes the limit of the host.
+func (l *hostRateLimiter) SetLimit(host string, rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if rate <= 0 {
+		delete(l.buckets, host)
+		return
+	}
+	l.buckets[host] = newTokenBucket(rate, burst)
+}
+
+func (l *hostRateLimiter) Wait(ctx context.Context, host string) error {
+	l.mu.Lock()
+	bucket := l.buckets[host]
+	l.mu.Unlock()
+
+	if bucket == nil {
+		return nil
+	}
+	return bucket.Wait(ctx)
+}
+
+// Limit the requests per second sent to the steam store and web API hosts. Media hosts aren't
+// limited.
+func configureSteamRateLimit(rate float64) {
+	for _, rawURL := range []string{steamStoreURL, steamAPIURL} {
+		if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+			rateLimiter.SetLimit(u.Host, rate, steamRateLimitBurst)
+		}
+	}
+}
+
+type rateLimitedTransport struct {
+	base    http.RoundTripper
+	limiter *hostRateLimiter
+}
+
+// Requests answered with 429 or 503 are sent again after the wait asked by Retry-After. The last
+// response is returned when the retries run out, so the caller reports its status.
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if err := t.limiter.Wait(req.Context(), req.URL.Host); err != nil {
+			return nil, err
+		}
+
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+
+		retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable
+		if !retryable || attempt == maxRateLimitRetries || req.Body != nil {
+			return resp, nil
+		}
+
+		wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if !ok {
+			wait = defaultRetryAfter
+		}
+		if wait > maxRetryAfter {
+			return resp, nil
+		}
+
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if err := sleepContext(req.Context(), wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Retry-After is either a number of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
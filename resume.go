@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/Eyevinn/hls-m3u8/m3u8"
+)
+
+// Progress of a trailer download, saved after every written segment so a killed or failed run can
+// be resumed. Segments are written in playlist order, so the completed ones are always the first
+// segments of each file.
+type resumeState struct {
+	mu   sync.Mutex
+	path string
+
+	AppID     string `json:"app_id"`
+	TrailerID int    `json:"trailer_id"`
+	Variant   string `json:"variant"`
+	// rendition of each audio track, in the same order of Audio
+	AudioTracks []string          `json:"audio_tracks"`
+	Video       resumeFileState   `json:"video"`
+	Audio       []resumeFileState `json:"audio"`
+}
+
+type resumeFileState struct {
+	Segments int `json:"segments"`
+	// end offset of every written segment, in playlist order
+	Offsets []int64 `json:"offsets"`
+}
+
+// Offset right after the last complete segment. Anything written past it is truncated.
+func (f *resumeFileState) lastOffset() int64 {
+	if len(f.Offsets) == 0 {
+		return 0
+	}
+	return f.Offsets[len(f.Offsets)-1]
+}
+
+// Variants are identified by their URI and attributes, since the playlist URLs carry tokens which
+// change between runs.
+func getVariantKey(variant *m3u8.Variant) string {
+	return fmt.Sprintf("%s|%s|%d|%s", variant.URI, variant.Resolution, variant.Bandwidth, variant.Codecs)
+}
+
+func loadResumeState(path string) (*resumeState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &resumeState{path: path}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid resume state [%s]: %w", path, err)
+	}
+	return state, nil
+}
+
+// The state only applies to the same trailer, variant and audio tracks, and to temporary files
+// still having every byte it says was written.
+func (s *resumeState) matches(trailerID int, variant *videoPlaylist, audio []*rendition, videoFile, audioFile string) bool {
+	if s.TrailerID != trailerID || s.Variant != getVariantKey(variant.variant) ||
+		s.Video.Segments != len(variant.segments) || len(s.AudioTracks) != len(audio) || len(s.Audio) != len(audio) {
+		return false
+	}
+
+	type fileState struct {
+		name  string
+		state *resumeFileState
+	}
+	files := []fileState{{videoFile, &s.Video}}
+	for i, r := range audio {
+		if s.AudioTracks[i] != getRenditionKey(r) || s.Audio[i].Segments != len(r.segments) {
+			return false
+		}
+		files = append(files, fileState{getTrackFileName(audioFile, i), &s.Audio[i]})
+	}
+
+	for _, file := range files {
+		info, err := os.Stat(file.name)
+		if err != nil || info.Size() < file.state.lastOffset() || len(file.state.Offsets) > file.state.Segments {
+			return false
+		}
+	}
+	return true
+}
+
+// Record a segment of the given size as written at the end of the file.
+func (s *resumeState) markWritten(file *resumeFileState, size int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file.Offsets = append(file.Offsets, file.lastOffset()+int64(size))
+	return s.save()
+}
+
+// Must be called holding the lock. The state is replaced at once, so a killed process never leaves
+// it half written.
+func (s *resumeState) save() error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+func (s *resumeState) remove() {
+	os.Remove(s.path)
+}
+
+// State left by the last run for the trailer, nil when resuming is disabled or there isn't any.
+func (e *Engine) getPreviousResumeState(trailerID int) *resumeState {
+	if !resumeDownloads {
+		return nil
+	}
+
+	state, err := loadResumeState(e.stateFileName)
+	if err != nil || state.TrailerID != trailerID {
+		return nil
+	}
+	return state
+}
+
+// Keep the state of the last run when it still applies to the chosen variant, otherwise the
+// download starts over.
+func (e *Engine) setupResumeState(previous *resumeState, trailerID int, videoPl *videoPlaylist, audio []*rendition) *resumeState {
+	if previous != nil && previous.matches(trailerID, videoPl, audio, e.videoFileName, e.audioFileName) {
+		return previous
+	}
+
+	state := &resumeState{
+		path:      e.stateFileName,
+		AppID:     e.steamAppId,
+		TrailerID: trailerID,
+		Variant:   getVariantKey(videoPl.variant),
+		Video:     resumeFileState{Segments: len(videoPl.segments)},
+	}
+	for _, r := range audio {
+		state.AudioTracks = append(state.AudioTracks, getRenditionKey(r))
+		state.Audio = append(state.Audio, resumeFileState{Segments: len(r.segments)})
+	}
+	return state
+}
+
+func findResumedVariant(state *resumeState, playlists []*videoPlaylist) *videoPlaylist {
+	if state == nil {
+		return nil
+	}
+
+	for _, pl := range playlists {
+		if getVariantKey(pl.variant) == state.Variant {
+			return pl
+		}
+	}
+	return nil
+}
+
+// Selector of the first trailer left by the last run, empty when there isn't any to resume.
+func (e *Engine) getResumedTrailerSelector(trailers []TrailerData) string {
+	for i, trailer := range trailers {
+		if _, err := loadResumeState(getTrailerTempFileName(e.steamAppId, trailer.ID, tmpStateFile)); err == nil {
+			return strconv.Itoa(i + 1)
+		}
+	}
+	return ""
+}
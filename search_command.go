@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Max number of candidates shown when an app name is prompted.
+const nameCandidatesLimit = 10
+
+// steam-query search [-limit 10] [-refresh] [-format table|json] <name>
+func runSearchCommand(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	limit := fs.Int("limit", 10, `max number of apps listed, 0 lists every match.`)
+	refresh := fs.Bool("refresh", false, `download the steam app list again, even if the cached one didn't expire.`)
+	format := fs.String("format", "table", `output format: "table" or "json".`)
+	fs.StringVar(&steamAPIURL, "api-url", getEnvString("STEAM_API_URL", defaultSteamAPIURL), `base URL of the steam web API.`)
+	registerStoreFlags(fs)
+	fs.Parse(args)
+
+	if err := applyStoreFlags(); err != nil {
+		return err
+	}
+
+	query := strings.Join(fs.Args(), " ")
+	if strings.TrimSpace(query) == "" {
+		return errors.New("missing app name to search")
+	}
+
+	index, err := loadAppIndex(ctx, NewSteamClient(steamAPIURL, newHTTPClient()), *refresh)
+	if err != nil {
+		return err
+	}
+
+	matches := index.Search(query, *limit)
+	switch *format {
+	case "table":
+		return writeMatchesTable(os.Stdout, matches)
+	case "json":
+		apps := make([]SteamApp, len(matches))
+		for i, match := range matches {
+			apps[i] = match.SteamApp
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(apps)
+	default:
+		return fmt.Errorf("unknown output format [%s]", *format)
+	}
+}
+
+func writeMatchesTable(out io.Writer, matches []appMatch) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "APP ID\tNAME\t")
+	for _, match := range matches {
+		fmt.Fprintf(w, "%d\t%s\t\n", match.ID, match.Name)
+	}
+	return w.Flush()
+}
+
+// Find the app ID of the given name. The top match is picked when it's the only one or its name is
+// the same of the query, otherwise the candidates are prompted to the user.
+func resolveAppName(ctx context.Context, query string) (string, error) {
+	index, err := loadAppIndex(ctx, NewSteamClient(steamAPIURL, newHTTPClient()), false)
+	if err != nil {
+		return "", err
+	}
+
+	matches := index.Search(query, nameCandidatesLimit)
+	if len(matches) == 0 {
+		return "", fmt.Errorf("didn't find any app named [%s]", query)
+	}
+
+	if len(matches) == 1 || normalizeAppName(matches[0].Name) == normalizeAppName(query) {
+		return strconv.Itoa(matches[0].ID), nil
+	}
+
+	fmt.Printf("Select which app matches [%s]:\n", query)
+	for i, match := range matches {
+		fmt.Printf(" [%d] %s (%d)\n", i+1, match.Name, match.ID)
+	}
+
+	selectedIdx, err := getInputNumber(ctx, 1, len(matches))
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(matches[selectedIdx-1].ID), nil
+}
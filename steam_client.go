@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSteamStoreURL = "https://store.steampowered.com"
+	defaultSteamAPIURL   = "https://api.steampowered.com"
+)
+
+// Steam answers the required age either as a number or as a string.
+type requiredAge int
+
+func (a *requiredAge) UnmarshalJSON(data []byte) error {
+	value, err := strconv.Atoi(strings.Trim(string(data), `"`))
+	if err != nil {
+		return fmt.Errorf("invalid required age %s", data)
+	}
+	*a = requiredAge(value)
+	return nil
+}
+
+type SteamPackageDetailsData struct {
+	Success bool                `json:"success"`
+	Data    SteamPackageDetails `json:"data"`
+}
+
+type SteamPackageDetails struct {
+	Name string            `json:"name"`
+	Apps []SteamPackageApp `json:"apps"`
+}
+
+type SteamPackageApp struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type SteamBundleDetails struct {
+	ID     int    `json:"bundleid"`
+	Name   string `json:"name"`
+	AppIDs []int  `json:"appids"`
+}
+
+type SteamApp struct {
+	ID   int    `json:"appid"`
+	Name string `json:"name"`
+}
+
+// Client for the Steam store API. The base URL can point to any server answering like the store does.
+type SteamClient struct {
+	baseURL       string
+	httpClient    *http.Client
+	matureContent bool
+	cache         *ResponseCache
+}
+
+func NewSteamClient(baseURL string, httpClient *http.Client) *SteamClient {
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+	return &SteamClient{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: httpClient,
+	}
+}
+
+// Options sent along the appdetails request.
+type AppDetailsOptions struct {
+	// Restrict the response to the given fields (e.g. "basic", "movies"). Empty means everything.
+	Filters []string
+	// Two letters country code (e.g. "us"). Empty lets steam pick it from the client IP.
+	CountryCode string
+	// Language name used by the store (e.g. "english", "brazilian").
+	Language string
+}
+
+// Store the cookies set by the store age check on the client jar, so mature titles answer with their
+// details instead of redirecting to the age gate. The jar is created when the client doesn't have one.
+func (c *SteamClient) AllowMatureContent() error {
+	storeURL, err := url.Parse(c.baseURL)
+	if err != nil {
+		return fmt.Errorf("invalid store URL [%s]: %w", c.baseURL, err)
+	}
+
+	if c.httpClient.Jar == nil {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			return err
+		}
+		c.httpClient.Jar = jar
+	}
+
+	c.httpClient.Jar.SetCookies(storeURL, []*http.Cookie{
+		// 1990-01-01, old enough for any age check
+		{Name: "birthtime", Value: "631152001", Path: "/"},
+		{Name: "lastagecheckage", Value: "1-0-1990", Path: "/"},
+		{Name: "mature_content", Value: "1", Path: "/"},
+		{Name: "wants_mature_content", Value: "1", Path: "/"},
+	})
+	c.matureContent = true
+	return nil
+}
+
+// Keep the store responses on the given cache, nil disables it.
+func (c *SteamClient) SetCache(cache *ResponseCache) {
+	c.cache = cache
+}
+
+func (o AppDetailsOptions) query(appID string) url.Values {
+	q := url.Values{}
+	q.Set("appids", appID)
+	if len(o.Filters) > 0 {
+		q.Set("filters", strings.Join(o.Filters, ","))
+	}
+	if o.CountryCode != "" {
+		q.Set("cc", o.CountryCode)
+	}
+	if o.Language != "" {
+		q.Set("l", o.Language)
+	}
+	return q
+}
+
+/**
+ * Errors returned by the client.
+ */
+
+// The response doesn't have any entry for the requested app, package or bundle.
+type NotFoundError struct {
+	Kind SteamInputKind
+	ID   string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("can't find %s [%s] details from steam API", e.Kind, e.ID)
+}
+
+// Steam answered with `success: false`, usually for unknown or region locked apps and packages.
+type UnavailableError struct {
+	Kind SteamInputKind
+	ID   string
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("steam API doesn't have details for %s [%s]", e.Kind, e.ID)
+}
+
+// The store asked for the user age, either redirecting to the age check page or hiding the movies
+// of an age restricted app.
+type AgeGateError struct {
+	ID  string
+	URL string
+}
+
+func (e *AgeGateError) Error() string {
+	if e.ID == "" {
+		return fmt.Sprintf("steam store redirected to the age check page [%s], mature content must be allowed", e.URL)
+	}
+	return fmt.Sprintf("app [%s] is age restricted, mature content must be allowed", e.ID)
+}
+
+type HTTPStatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status [%d %s] from [%s]", e.StatusCode, http.StatusText(e.StatusCode), e.URL)
+}
+
+// The server kept answering 429 after every retry. RetryAfter is zero when it didn't say how long
+// to wait.
+type RateLimitedError struct {
+	HTTPStatusError
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	if e.RetryAfter == 0 {
+		return fmt.Sprintf("rate limited by [%s]", e.URL)
+	}
+	return fmt.Sprintf("rate limited by [%s], retry after %s", e.URL, e.RetryAfter)
+}
+
+func (e *RateLimitedError) Unwrap() error {
+	return &e.HTTPStatusError
+}
+
+// The server answered with a page instead of the expected content, usually an error page sent with
+// a 200 status.
+type UnexpectedContentError struct {
+	URL         string
+	ContentType string
+	Expected    string
+}
+
+func (e *UnexpectedContentError) Error() string {
+	return fmt.Sprintf("expected %s from [%s], got [%s] content", e.Expected, e.URL, e.ContentType)
+}
+
+type DecodeError struct {
+	URL string
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("can't decode response from [%s]: %v", e.URL, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+type DecryptError struct {
+	URL    string
+	Reason string
+}
+
+func (e *DecryptError) Error() string {
+	return fmt.Sprintf("can't decrypt [%s]: %s", e.URL, e.Reason)
+}
+
+func checkResponseStatus(resp *http.Response) error {
+	reqURL := resp.Request.URL.String()
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		retryAfter, _ := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		return &RateLimitedError{
+			HTTPStatusError: HTTPStatusError{URL: reqURL, StatusCode: resp.StatusCode},
+			RetryAfter:      retryAfter,
+		}
+	case resp.StatusCode != http.StatusOK:
+		return &HTTPStatusError{URL: reqURL, StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// Check the status of a response expected to have the given content (e.g. "JSON"), rejecting HTML
+// pages before they reach the decoders.
+func checkResponse(resp *http.Response, expected string) error {
+	if err := checkResponseStatus(resp); err != nil {
+		return err
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); strings.HasPrefix(contentType, "text/html") {
+		return &UnexpectedContentError{URL: resp.Request.URL.String(), ContentType: contentType, Expected: expected}
+	}
+	return nil
+}
+
+/**
+ * Endpoints.
+ */
+
+func (c *SteamClient) AppDetails(ctx context.Context, appID string, opts AppDetailsOptions) (SteamAppDetails, error) {
+	var wrapper map[string]SteamAppDetailsData
+	if err := c.getJSON(ctx, "/api/appdetails", opts.query(appID), appDetailsCacheTTL, &wrapper); err != nil {
+		return SteamAppDetails{}, err
+	}
+
+	data, ok := wrapper[appID]
+	if !ok {
+		return SteamAppDetails{}, &NotFoundError{Kind: AppInput, ID: appID}
+	}
+	if !data.Success {
+		return SteamAppDetails{}, &UnavailableError{Kind: AppInput, ID: appID}
+	}
+
+	// without the age check cookies steam hides the movies of restricted apps
+	if !c.matureContent && data.Data.RequiredAge > 0 && len(data.Data.Trailers) == 0 {
+		return SteamAppDetails{}, &AgeGateError{ID: appID}
+	}
+
+	return data.Data, nil
+}
+
+// Query the app details on every given country, merging trailers which differ between them.
+// Fields other than trailers come from the first country answering with the app details.
+// Countries where the app isn't available are skipped.
+func (c *SteamClient) MergedAppDetails(ctx context.Context, appID string, opts AppDetailsOptions, countryCodes []string) (SteamAppDetails, error) {
+	var (
+		merged  SteamAppDetails
+		found   bool
+		lastErr error
+	)
+	seen := make(map[int]bool)
+	for _, cc := range countryCodes {
+		opts.CountryCode = cc
+		details, err := c.AppDetails(ctx, appID, opts)
+		if err != nil {
+			var unavailable *UnavailableError
+			if errors.As(err, &unavailable) {
+				lastErr = err
+				continue
+			}
+			return SteamAppDetails{}, fmt.Errorf("country [%s]: %w", cc, err)
+		}
+
+		if !found {
+			merged = details
+			merged.Trailers = nil
+			found = true
+		}
+		for _, trailer := range details.Trailers {
+			if !seen[trailer.ID] {
+				seen[trailer.ID] = true
+				merged.Trailers = append(merged.Trailers, trailer)
+			}
+		}
+	}
+
+	if !found {
+		return SteamAppDetails{}, lastErr
+	}
+	return merged, nil
+}
+
+func (c *SteamClient) PackageDetails(ctx context.Context, packageID string) (SteamPackageDetails, error) {
+	var wrapper map[string]SteamPackageDetailsData
+	if err := c.getJSON(ctx, "/api/packagedetails", url.Values{"packageids": {packageID}}, appDetailsCacheTTL, &wrapper); err != nil {
+		return SteamPackageDetails{}, err
+	}
+
+	data, ok := wrapper[packageID]
+	if !ok {
+		return SteamPackageDetails{}, &NotFoundError{Kind: PackageInput, ID: packageID}
+	}
+	if !data.Success {
+		return SteamPackageDetails{}, &UnavailableError{Kind: PackageInput, ID: packageID}
+	}
+
+	return data.Data, nil
+}
+
+// The store API doesn't have a bundle details endpoint, so bundles are resolved through the same
+// endpoint used by the store pages.
+func (c *SteamClient) BundleDetails(ctx context.Context, bundleID string) (SteamBundleDetails, error) {
+	var bundles []SteamBundleDetails
+	if err := c.getJSON(ctx, "/actions/ajaxresolvebundles", url.Values{"bundleids": {bundleID}}, appDetailsCacheTTL, &bundles); err != nil {
+		return SteamBundleDetails{}, err
+	}
+
+	for _, bundle := range bundles {
+		if strconv.Itoa(bundle.ID) == bundleID {
+			return bundle, nil
+		}
+	}
+	return SteamBundleDetails{}, &NotFoundError{Kind: BundleInput, ID: bundleID}
+}
+
+// Expand a package or bundle into the IDs of the apps it contains.
+func (c *SteamClient) ExpandAppIDs(ctx context.Context, input SteamInput) ([]string, error) {
+	switch input.Kind {
+	case AppInput:
+		return []string{input.ID}, nil
+	case PackageInput:
+		pkg, err := c.PackageDetails(ctx, input.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		appIDs := make([]string, len(pkg.Apps))
+		for i, app := range pkg.Apps {
+			appIDs[i] = strconv.Itoa(app.ID)
+		}
+		return appIDs, nil
+	case BundleInput:
+		bundle, err := c.BundleDetails(ctx, input.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		appIDs := make([]string, len(bundle.AppIDs))
+		for i, appID := range bundle.AppIDs {
+			appIDs[i] = strconv.Itoa(appID)
+		}
+		return appIDs, nil
+	}
+	return nil, fmt.Errorf("can't expand steam %s [%s]", input.Kind, input.ID)
+}
+
+// List every app known by steam. The list is served by the web API, so the client must be created
+// with its URL instead of the store one.
+func (c *SteamClient) AppList(ctx context.Context) ([]SteamApp, error) {
+	var wrapper struct {
+		AppList struct {
+			Apps []SteamApp `json:"apps"`
+		} `json:"applist"`
+	}
+	if err := c.getJSON(ctx, "/ISteamApps/GetAppList/v2/", url.Values{}, 0, &wrapper); err != nil {
+		return nil, err
+	}
+	return wrapper.AppList.Apps, nil
+}
+
+// Responses are cached for the given TTL, zero skips the cache (e.g. for the app list, which has
+// its own index).
+func (c *SteamClient) getJSON(ctx context.Context, endpoint string, query url.Values, ttl time.Duration, v any) error {
+	reqURL := fmt.Sprintf("%s%s?%s", c.baseURL, endpoint, query.Encode())
+	body, err := c.cache.Get(ctx, c.httpClient, reqURL, ttl, func(resp *http.Response) error {
+		if strings.Contains(resp.Request.URL.Path, "agecheck") {
+			return &AgeGateError{URL: resp.Request.URL.String()}
+		}
+		return checkResponse(resp, "JSON")
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return &DecodeError{URL: reqURL, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+type SteamInputKind int
+
+const (
+	AppInput SteamInputKind = iota
+	PackageInput
+	BundleInput
+)
+
+func (k SteamInputKind) String() string {
+	switch k {
+	case AppInput:
+		return "app"
+	case PackageInput:
+		return "package"
+	case BundleInput:
+		return "bundle"
+	}
+	return "unknown"
+}
+
+// Steam entity referenced by an URL given by the user.
+type SteamInput struct {
+	Kind SteamInputKind
+	ID   string
+}
+
+var (
+	steamStoreHosts = []string{"store.steampowered.com", "steamcommunity.com"}
+
+	// /app/<id>[/slug], /agecheck/app/<id>, /sub/<id> and /bundle/<id>
+	storePathPattern = regexp.MustCompile("^/(?:agecheck/)?(app|sub|bundle)/([0-9]+)(?:/.*)?$")
+	// steam://store/<id>
+	deepLinkPathPattern = regexp.MustCompile("^/([0-9]+)/?$")
+)
+
+// Resolve store pages, community hubs and steam:// deep links. Query strings (e.g. localization
+// parameters) are ignored and the scheme is optional for web URLs.
+func resolveSteamURL(rawURL string) (SteamInput, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + rawURL
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return SteamInput{}, fmt.Errorf("invalid URL [%s]: %w", rawURL, err)
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "steam":
+		if matches := deepLinkPathPattern.FindStringSubmatch(u.Path); u.Host == "store" && matches != nil {
+			return SteamInput{Kind: AppInput, ID: matches[1]}, nil
+		}
+	case "http", "https":
+		host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+		if !slices.Contains(steamStoreHosts, host) {
+			return SteamInput{}, fmt.Errorf("unknown steam host [%s]", u.Host)
+		}
+
+		matches := storePathPattern.FindStringSubmatch(u.Path)
+		if matches == nil {
+			break
+		}
+
+		switch matches[1] {
+		case "app":
+			return SteamInput{Kind: AppInput, ID: matches[2]}, nil
+		case "sub":
+			return SteamInput{Kind: PackageInput, ID: matches[2]}, nil
+		case "bundle":
+			return SteamInput{Kind: BundleInput, ID: matches[2]}, nil
+		}
+	}
+
+	return SteamInput{}, fmt.Errorf("didn't find any matches for page URL [%s]", rawURL)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+type SubtitleMode string
+
+const (
+	NoSubtitles      SubtitleMode = "none"
+	SidecarSubtitles SubtitleMode = "sidecar"
+	MuxedSubtitles   SubtitleMode = "mux"
+)
+
+func parseSubtitleMode(value string) (SubtitleMode, error) {
+	switch mode := SubtitleMode(strings.ToLower(value)); mode {
+	case NoSubtitles, SidecarSubtitles, MuxedSubtitles:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown subtitles mode [%s]", value)
+}
+
+// Download the WebVTT segments of the rendition, merging them into a single WebVTT file.
+func (e *Engine) downloadSubtitles(ctx context.Context, r *rendition) ([]byte, error) {
+	segments := make([][]byte, len(r.segments))
+
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(segmentConcurrency)
+	for i, seg := range r.segments {
+		g.Go(func() error {
+			data, err := e.fetchSegmentWithRetry(gCtx, seg, func() {
+				e.segmentRetries.Add(1)
+			})
+			if err != nil {
+				return fmt.Errorf("segment [%s]: %w", seg.name(), err)
+			}
+			segments[i] = data
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return mergeWebVTT(segments)
+}
+
+// Sidecar files are named after the output file and the language tag, e.g.
+// "<game> - <trailer> [<movie id>].pt-BR.vtt", so players load them along the video. Renditions
+// sharing the same language are numbered.
+func getSidecarFileNames(outputPath string, renditions []*rendition) []string {
+	base := strings.TrimSuffix(outputPath, filepath.Ext(outputPath))
+
+	names := make([]string, len(renditions))
+	used := make(map[string]int)
+	for i, r := range renditions {
+		lang := sanitizeFileName(r.language)
+		if lang == "" {
+			lang = "und"
+		}
+
+		used[lang]++
+		if n := used[lang]; n > 1 {
+			names[i] = fmt.Sprintf("%s.%s.%d.vtt", base, lang, n)
+		} else {
+			names[i] = fmt.Sprintf("%s.%s.vtt", base, lang)
+		}
+	}
+	return names
+}
+
+/**
+ * WebVTT merging.
+ */
+
+type webvttCue struct {
+	id       string
+	start    time.Duration
+	end      time.Duration
+	settings string
+	text     string
+}
+
+type webvttFile struct {
+	// MPEG-2 timestamp matching the local time zero of the cues, from X-TIMESTAMP-MAP
+	offset    time.Duration
+	hasOffset bool
+	// STYLE and REGION blocks
+	blocks []string
+	cues   []webvttCue
+}
+
+// X-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000
+var (
+	timestampMapPattern = regexp.MustCompile(`^X-TIMESTAMP-MAP=`)
+	mpegtsPattern       = regexp.MustCompile(`MPEGTS:(\d+)`)
+	localTimePattern    = regexp.MustCompile(`LOCAL:([\d:.]+)`)
+	blockSeparator      = regexp.MustCompile(`\n{2,}`)
+)
+
+// Each segment is a whole WebVTT file. Their headers are dropped but the first one, cue times are
+// moved to the timeline of the first segment when their X-TIMESTAMP-MAP differ, and cues repeated
+// by consecutive segments (the ones crossing a segment boundary) are only kept once.
+func mergeWebVTT(segments [][]byte) ([]byte, error) {
+	var (
+		out   bytes.Buffer
+		first *webvttFile
+		seen  = make(map[webvttCue]bool)
+	)
+
+	out.WriteString("WEBVTT\n")
+	for i, data := range segments {
+		file, err := parseWebVTT(data)
+		if err != nil {
+			return nil, fmt.Errorf("segment %d: %w", i+1, err)
+		}
+
+		if first == nil {
+			first = file
+			for _, block := range file.blocks {
+				out.WriteString("\n" + block + "\n")
+			}
+		}
+
+		var shift time.Duration
+		if file.hasOffset && first.hasOffset {
+			shift = file.offset - first.offset
+		}
+
+		for _, cue := range file.cues {
+			cue.start += shift
+			cue.end += shift
+			if seen[cue] {
+				continue
+			}
+			seen[cue] = true
+
+			out.WriteString("\n")
+			if cue.id != "" {
+				out.WriteString(cue.id + "\n")
+			}
+			fmt.Fprintf(&out, "%s --> %s", formatWebVTTTimestamp(cue.start), formatWebVTTTimestamp(cue.end))
+			if cue.settings != "" {
+				out.WriteString(" " + cue.settings)
+			}
+			out.WriteString("\n" + cue.text + "\n")
+		}
+	}
+	return out.Bytes(), nil
+}
+
+func parseWebVTT(data []byte) (*webvttFile, error) {
+	text := strings.TrimPrefix(string(data), "\uFEFF")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+
+	blocks := blockSeparator.Split(strings.TrimSpace(text), -1)
+	if len(blocks) == 0 || !strings.HasPrefix(blocks[0], "WEBVTT") {
+		return nil, errors.New("missing WEBVTT header")
+	}
+
+	file := &webvttFile{}
+	for _, line := range strings.Split(blocks[0], "\n")[1:] {
+		if !timestampMapPattern.MatchString(line) {
+			continue
+		}
+		offset, err := parseTimestampMap(line)
+		if err != nil {
+			return nil, err
+		}
+		file.offset, file.hasOffset = offset, true
+	}
+
+	for _, block := range blocks[1:] {
+		switch {
+		case strings.HasPrefix(block, "NOTE"):
+			continue
+		case strings.HasPrefix(block, "STYLE"), strings.HasPrefix(block, "REGION"):
+			file.blocks = append(file.blocks, block)
+			continue
+		}
+
+		lines := strings.Split(block, "\n")
+		cue := webvttCue{}
+		if !strings.Contains(lines[0], "-->") {
+			cue.id, lines = lines[0], lines[1:]
+		}
+		if len(lines) == 0 {
+			return nil, fmt.Errorf("cue [%s] without timing", cue.id)
+		}
+
+		startValue, timing, ok := strings.Cut(lines[0], "-->")
+		if !ok {
+			return nil, fmt.Errorf("invalid cue timing [%s]", lines[0])
+		}
+		fields := strings.Fields(timing)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("invalid cue timing [%s]", lines[0])
+		}
+
+		var err error
+		if cue.start, err = parseWebVTTTimestamp(strings.TrimSpace(startValue)); err != nil {
+			return nil, err
+		}
+		if cue.end, err = parseWebVTTTimestamp(fields[0]); err != nil {
+			return nil, err
+		}
+		cue.settings = strings.Join(fields[1:], " ")
+		cue.text = strings.Join(lines[1:], "\n")
+		file.cues = append(file.cues, cue)
+	}
+	return file, nil
+}
+
+// The offset is the MPEG-2 timestamp (90kHz) minus the local time it maps to.
+func parseTimestampMap(line string) (time.Duration, error) {
+	mpegts := mpegtsPattern.FindStringSubmatch(line)
+	local := localTimePattern.FindStringSubmatch(line)
+	if mpegts == nil || local == nil {
+		return 0, fmt.Errorf("invalid X-TIMESTAMP-MAP [%s]", line)
+	}
+
+	ticks, err := strconv.ParseInt(mpegts[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid X-TIMESTAMP-MAP [%s]: %w", line, err)
+	}
+	localTime, err := parseWebVTTTimestamp(local[1])
+	if err != nil {
+		return 0, err
+	}
+	// 90kHz ticks are 100000/9 nanoseconds
+	return time.Duration(ticks*100000/9) - localTime, nil
+}
+
+// Timestamps are written as [hh:]mm:ss.ttt
+func parseWebVTTTimestamp(value string) (time.Duration, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid WebVTT timestamp [%s]", value)
+	}
+
+	seconds, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid WebVTT timestamp [%s]", value)
+	}
+	total := time.Duration(seconds * float64(time.Second)).Round(time.Millisecond)
+
+	for i, unit := range []time.Duration{time.Minute, time.Hour}[:len(parts)-1] {
+		n, err := strconv.Atoi(parts[len(parts)-2-i])
+		if err != nil {
+			return 0, fmt.Errorf("invalid WebVTT timestamp [%s]", value)
+		}
+		total += time.Duration(n) * unit
+	}
+	return total, nil
+}
+
+func formatWebVTTTimestamp(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// Write the subtitles files next to the output file.
+func writeSidecarSubtitles(outputPath string, renditions []*rendition, files [][]byte) error {
+	for i, name := range getSidecarFileNames(outputPath, renditions) {
+		if err := os.WriteFile(name, files[i], 0o644); err != nil {
+			return fmt.Errorf("write subtitles [%s]: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWebVTTTimestamp(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "01:02:03.456", want: time.Hour + 2*time.Minute + 3456*time.Millisecond},
+		{value: "00:00:00.000", want: 0},
+		{value: "02:03.456", want: 2*time.Minute + 3456*time.Millisecond},
+		{value: "00:59.999", want: 59999 * time.Millisecond},
+		{value: "3.456", wantErr: true},
+		{value: "1:2:3:4.000", wantErr: true},
+		{value: "aa:03.456", wantErr: true},
+		{value: "00:bb", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseWebVTTTimestamp(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("parseWebVTTTimestamp(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTimestampMap(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    time.Duration
+		wantErr bool
+	}{
+		{line: "X-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000", want: 10 * time.Second},
+		{line: "X-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:01.000", want: 9 * time.Second},
+		{line: "X-TIMESTAMP-MAP=LOCAL:00:00.000,MPEGTS:90000", want: time.Second},
+		// a day of 90kHz ticks doesn't overflow
+		{line: "X-TIMESTAMP-MAP=MPEGTS:7776000000,LOCAL:00:00:00.000", want: 24 * time.Hour},
+		{line: "X-TIMESTAMP-MAP=LOCAL:00:00:00.000", wantErr: true},
+		{line: "X-TIMESTAMP-MAP=MPEGTS:900000", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, err := parseTimestampMap(tt.line)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("parseTimestampMap(%q) = %v, want %v", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeWebVTT(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name: "timestamp map shift",
+			segments: []string{
+				"WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n00:00.000 --> 00:02.000\nfirst\n",
+				"WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:1260000,LOCAL:00:00:00.000\n\n00:00.500 --> 00:01.000 align:start\nsecond\n",
+			},
+			want: "WEBVTT\n" +
+				"\n00:00:00.000 --> 00:00:02.000\nfirst\n" +
+				"\n00:00:04.500 --> 00:00:05.000 align:start\nsecond\n",
+		},
+		{
+			name: "segments without timestamp map",
+			segments: []string{
+				"WEBVTT\n\n00:01.000 --> 00:02.000\nfirst\n",
+				"WEBVTT\n\n00:05.000 --> 00:06.000\nsecond\n",
+			},
+			want: "WEBVTT\n" +
+				"\n00:00:01.000 --> 00:00:02.000\nfirst\n" +
+				"\n00:00:05.000 --> 00:00:06.000\nsecond\n",
+		},
+		{
+			name: "cues repeated across segments",
+			segments: []string{
+				"WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n1\n00:00:01.000 --> 00:00:02.000\nfirst\n\n2\n00:00:03.000 --> 00:00:05.000\ncrossing\nthe boundary\n",
+				"WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:900000,LOCAL:00:00:00.000\n\n2\n00:00:03.000 --> 00:00:05.000\ncrossing\nthe boundary\n\n3\n00:00:05.000 --> 00:00:06.000\nlast\n",
+			},
+			want: "WEBVTT\n" +
+				"\n1\n00:00:01.000 --> 00:00:02.000\nfirst\n" +
+				"\n2\n00:00:03.000 --> 00:00:05.000\ncrossing\nthe boundary\n" +
+				"\n3\n00:00:05.000 --> 00:00:06.000\nlast\n",
+		},
+		{
+			name: "BOM and CRLF",
+			segments: []string{
+				"\uFEFFWEBVTT\r\n\r\n00:01.000 --> 00:02.000\r\nfirst line\r\nsecond line\r\n",
+				"\uFEFFWEBVTT\r\r00:03.000 --> 00:04.000\rold mac\r",
+			},
+			want: "WEBVTT\n" +
+				"\n00:00:01.000 --> 00:00:02.000\nfirst line\nsecond line\n" +
+				"\n00:00:03.000 --> 00:00:04.000\nold mac\n",
+		},
+		{
+			name: "style of the first segment, without notes",
+			segments: []string{
+				"WEBVTT\n\nSTYLE\n::cue { color: yellow }\n\nNOTE a comment\n\n00:01.000 --> 00:02.000\nfirst\n",
+				"WEBVTT\n\nSTYLE\n::cue { color: red }\n\n00:03.000 --> 00:04.000\nsecond\n",
+			},
+			want: "WEBVTT\n" +
+				"\nSTYLE\n::cue { color: yellow }\n" +
+				"\n00:00:01.000 --> 00:00:02.000\nfirst\n" +
+				"\n00:00:03.000 --> 00:00:04.000\nsecond\n",
+		},
+		{
+			name:     "missing header",
+			segments: []string{"WEBVTT\n\n00:01.000 --> 00:02.000\nfirst\n", "00:03.000 --> 00:04.000\nsecond\n"},
+			wantErr:  true,
+		},
+		{
+			name:     "invalid cue timing",
+			segments: []string{"WEBVTT\n\n00:01.000 -> 00:02.000\nfirst\n"},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segments := make([][]byte, len(tt.segments))
+			for i, seg := range tt.segments {
+				segments[i] = []byte(seg)
+			}
+
+			got, err := mergeWebVTT(segments)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("mergeWebVTT() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}